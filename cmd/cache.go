@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// fileCache keeps photos on disk by their Telegram file ids, so they survive
+// restarts even if the download links expire. A nil cache caches nothing.
+type fileCache struct {
+	dir string
+}
+
+func newFileCache(dir string) (*fileCache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+
+	return &fileCache{dir: dir}, nil
+}
+
+func (c *fileCache) path(fileID string) string {
+	// file ids are safe for file names, but tests use ones with slashes
+	return filepath.Join(c.dir, url.PathEscape(fileID))
+}
+
+// Get returns the cached photo, ok is false if it isn't cached.
+func (c *fileCache) Get(fileID string) (data []byte, ok bool) {
+	if c == nil || fileID == "" {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(c.path(fileID))
+	if err != nil {
+		return nil, false
+	}
+
+	return data, true
+}
+
+func (c *fileCache) Put(fileID string, data []byte) error {
+	if c == nil || fileID == "" {
+		return nil
+	}
+
+	// written to a temporary file first, so a crash doesn't leave a broken photo
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return fmt.Errorf("create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write cache file: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("close cache file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), c.path(fileID))
+	if err != nil {
+		return fmt.Errorf("rename cache file: %w", err)
+	}
+
+	return nil
+}
+
+// Delete evicts the photos from the cache, missing ones are ignored.
+func (c *fileCache) Delete(fileIDs ...string) error {
+	if c == nil {
+		return nil
+	}
+
+	var funcErr error
+	for _, fileID := range fileIDs {
+		if fileID == "" {
+			continue
+		}
+
+		err := os.Remove(c.path(fileID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			funcErr = errors.Join(funcErr, fmt.Errorf("evict cached file: %w", err))
+		}
+	}
+
+	return funcErr
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestFileCache(t *testing.T) {
+	is := is.New(t)
+
+	c, err := newFileCache(t.TempDir())
+	is.NoErr(err)
+
+	_, ok := c.Get("0/red.jpeg")
+	is.True(!ok)
+
+	is.NoErr(c.Put("0/red.jpeg", []byte("photo")))
+	data, ok := c.Get("0/red.jpeg")
+	is.True(ok)
+	is.Equal([]byte("photo"), data)
+
+	is.NoErr(c.Delete("0/red.jpeg", "missing"))
+	_, ok = c.Get("0/red.jpeg")
+	is.True(!ok)
+
+	// a disabled cache caches nothing
+	var disabled *fileCache
+	is.NoErr(disabled.Put("red.jpeg", []byte("photo")))
+	_, ok = disabled.Get("red.jpeg")
+	is.True(!ok)
+	is.NoErr(disabled.Delete("red.jpeg"))
+}
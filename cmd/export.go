@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// dump is the JSON form of the database used by Export and Import.
+type dump struct {
+	Chats []dumpChat `json:"chats"`
+	Links []dumpLink `json:"links"`
+}
+
+type dumpChat struct {
+	ChatID    int64 `json:"chat_id"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type dumpLink struct {
+	ChatID       int64  `json:"chat_id"`
+	MessageID    int64  `json:"message_id"`
+	Timestamp    int64  `json:"timestamp"`
+	URL          string `json:"url"`
+	Caption      string `json:"caption,omitempty"`
+	FileID       string `json:"file_id,omitempty"`
+	MediaGroupID string `json:"media_group_id,omitempty"`
+	Done         bool   `json:"done,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	FileSize     int    `json:"file_size,omitempty"`
+}
+
+// Export writes chats and links as JSON, which is more portable than the database file.
+func (s *storage) Export(ctx context.Context, w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d := dump{Chats: []dumpChat{}, Links: []dumpLink{}}
+
+	rows, err := s.db.QueryContext(ctx, `select chat_id, timestamp from chats order by chat_id`)
+	if err != nil {
+		return fmt.Errorf("select chats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c dumpChat
+		err := rows.Scan(&c.ChatID, &c.Timestamp)
+		if err != nil {
+			return fmt.Errorf("scan chat: %w", err)
+		}
+		d.Chats = append(d.Chats, c)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("select chats: %w", err)
+	}
+
+	rows, err = s.db.QueryContext(ctx,
+		`select chat_id, message_id, timestamp, url, caption, file_id, media_group_id, done, width, height, file_size from links order by chat_id, timestamp, message_id`,
+	)
+	if err != nil {
+		return fmt.Errorf("select links: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l dumpLink
+		err := rows.Scan(&l.ChatID, &l.MessageID, &l.Timestamp, &l.URL, &l.Caption, &l.FileID, &l.MediaGroupID, &l.Done, &l.Width, &l.Height, &l.FileSize)
+		if err != nil {
+			return fmt.Errorf("scan link: %w", err)
+		}
+		d.Links = append(d.Links, l)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("select links: %w", err)
+	}
+
+	err = json.NewEncoder(w).Encode(d)
+	if err != nil {
+		return fmt.Errorf("encode dump: %w", err)
+	}
+
+	return nil
+}
+
+// Import loads chats and links written by Export in a single transaction.
+// Chats and links already in the database are replaced.
+func (s *storage) Import(ctx context.Context, r io.Reader) error {
+	var d dump
+	err := json.NewDecoder(r).Decode(&d)
+	if err != nil {
+		return fmt.Errorf("decode dump: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, c := range d.Chats {
+		_, err := tx.ExecContext(ctx,
+			`insert into chats (chat_id, timestamp) values(?,?) on conflict(chat_id) do update set timestamp = excluded.timestamp`,
+			c.ChatID, c.Timestamp,
+		)
+		if err != nil {
+			return fmt.Errorf("import chat %d: %w", c.ChatID, err)
+		}
+	}
+
+	for _, l := range d.Links {
+		err := chatExists(ctx, tx, l.ChatID)
+		if err != nil {
+			return err
+		}
+
+		// links have no unique key, a message has a single photo though
+		_, err = tx.ExecContext(ctx, `delete from links where chat_id = ? and message_id = ?`, l.ChatID, l.MessageID)
+		if err != nil {
+			return fmt.Errorf("import link %d: %w", l.MessageID, err)
+		}
+		_, err = tx.ExecContext(ctx,
+			`insert into links (chat_id, timestamp, url, message_id, caption, file_id, media_group_id, done, width, height, file_size) values (?,?,?,?,?,?,?,?,?,?,?)`,
+			l.ChatID, l.Timestamp, l.URL, l.MessageID, l.Caption, l.FileID, l.MediaGroupID, l.Done, l.Width, l.Height, l.FileSize,
+		)
+		if err != nil {
+			return fmt.Errorf("import link %d: %w", l.MessageID, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit import: %w", err)
+	}
+
+	return nil
+}
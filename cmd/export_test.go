@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestStorageExportImport(t *testing.T) {
+	is := is.New(t)
+
+	ctx := context.TODO()
+	src := newTestStorage(t, is)
+	is.NoErr(src.RegisterChat(ctx, 42, time.Unix(200, 0)))
+
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.UTC)
+	is.NoErr(src.RegisterLinks(ctx, []Link{
+		{ChatID: 1337, MessageID: 1, Date: day, URL: "http://a", Caption: "breakfast", FileID: "a", Width: 1280, Height: 960, FileSize: 4096},
+		{ChatID: 1337, MessageID: 2, Date: day.Add(time.Minute), URL: "http://b", MediaGroupID: "album"},
+		{ChatID: 42, MessageID: 3, Date: day, URL: "http://c"},
+	}))
+	is.NoErr(src.MarkDone(ctx, 42, []int{3}))
+
+	buf := &bytes.Buffer{}
+	is.NoErr(src.Export(ctx, buf))
+	dumped := buf.String()
+
+	dst := newTestStorage(t, is)
+	is.NoErr(dst.Import(ctx, bytes.NewBufferString(dumped)))
+	// importing again replaces the same chats and links
+	is.NoErr(dst.Import(ctx, bytes.NewBufferString(dumped)))
+
+	chats, err := dst.Chats(ctx)
+	is.NoErr(err)
+	is.Equal([]int64{42, 1337}, chats)
+
+	messages, toCollage, err := dst.Links(ctx, 1337, time.UTC)
+	is.NoErr(err)
+	is.Equal([]int{1, 2}, messages)
+	is.Equal([]string{"http://a", "http://b"}, toCollage[0].links)
+	is.Equal([]string{"breakfast", ""}, toCollage[0].captions)
+	is.Equal([]string{"a", ""}, toCollage[0].fileIDs)
+	is.Equal([]string{"", "album"}, toCollage[0].mediaGroups)
+
+	pending, err := dst.PendingCount(ctx, 42)
+	is.NoErr(err)
+	is.Equal(0, pending)
+
+	buf.Reset()
+	is.NoErr(dst.Export(ctx, buf))
+	is.Equal(dumped, buf.String())
+}
@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"image/color"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	_ "time/tzdata"
 
@@ -22,33 +29,166 @@ import (
 	"github.com/nikgalushko/collagify-tg/pkg/image"
 )
 
-var (
-	BuildTime string
-	moscowLoc *time.Location
-)
+var BuildTime string
 
 const (
-	tmpDBPath         = "/tmp/collagify.sqlite"
-	crontab           = "CRON_TZ=Europe/Moscow 59 23 * * *"
-	apiTelegramServer = "https://api.telegram.org"
+	tmpDBPath = "/tmp/collagify.sqlite"
+	crontab   = "59 23 * * *"
+	defaultTZ = "Europe/Moscow"
+	// storage maintenance runs at night when nothing is posted
+	maintenanceCrontab = "30 4 * * *"
+	apiTelegramServer  = "https://api.telegram.org"
+	defaultMaxCols     = 5
+	// larger days are split into several collages
+	maxImagesPerCollage        = 25
+	defaultMinImages           = 2
+	defaultDownloadTimeout     = 30 * time.Second
+	defaultDownloadConcurrency = 4
+	defaultChatConcurrency     = 4
+	downloadAttempts           = 3
+	maxDeleteMessages          = 100
+	maxAlbumSize               = 10
+	maxSummaryErrors           = 10
+	rateLimitAttempts          = 5
+	defaultShutdownTimeout     = time.Minute
+	maxSummaryErrorLen         = 300
+	defaultDownloadBackoff     = time.Second
+	sendAttempts               = 3
+	defaultSendBackoff         = time.Second
+	// placeholders are {chat}, {date} and {count}, pages and the extension are appended
+	defaultFilenameTemplate = "collage_{date}"
+
+	// limits of the /cols command
+	minColsSetting = 1
+	maxColsSetting = 10
+
+	// telegram rejects photos over the limits
+	telegramMaxSideSum = 10000
+	telegramMaxRatio   = 20
+
+	// overflow strategies for days with more photos than allowed
+	overflowRecent   = "recent"
+	overflowSample   = "sample"
+	overflowPaginate = "paginate"
+
+	// output formats of collages
+	outputJPEG = "jpeg"
+	outputPNG  = "png"
+
+	chatTypeGroup      = "group"
+	chatTypeSupergroup = "supergroup"
 )
 
 type App struct {
-	log       *slog.Logger
-	crn       *cron.Cron
-	bt        *bot.Bot
-	db        *storage
-	serverURL string
+	log *slog.Logger
+	crn *cron.Cron
+	// collageEntry is the cron entry of collages
+	collageEntry cron.EntryID
+	// cronSpec is the schedule of collages
+	cronSpec     string
+	bt           *bot.Bot
+	db           *storage
+	serverURL    string
+	collageOpts  []image.Option
+	minImages    int
+	maxCols      int
+	filenameTmpl string
+	// loc is the zone of the days photos are grouped by
+	loc *time.Location
+	// client downloads photos
+	client          *http.Client
+	downloadTimeout time.Duration
+	// downloadBackoff is the delay before the first retry of a failed download, doubled on every next one
+	downloadBackoff time.Duration
+	// downloadConcurrency limits photos downloaded at the same time
+	downloadConcurrency int
+	// chatConcurrency limits chats collaged at the same time
+	chatConcurrency int
+	// skipFailedDownloads makes a collage of the rest photos if some fail to download
+	skipFailedDownloads bool
+	// maxImagesPerDay limits photos of a day in the way of overflow, unlimited if zero
+	maxImagesPerDay int
+	overflow        string
+	// dryRun builds collages without sending them and keeps the links
+	dryRun  bool
+	metrics *metrics
+	// adminChatID is notified about cron errors if set
+	adminChatID int64
+	// adminSummary sends stats of every cron run to the admin chat
+	adminSummary bool
+	// cache keeps photos from registration till the collage, nil if disabled
+	cache *fileCache
+	// retryAfterUnit is the unit of Telegram retry_after delays
+	retryAfterUnit time.Duration
+	// sendBackoff is the delay before the first retry of a failed collage send
+	sendBackoff time.Duration
+	// ctx of jobs is cancelled on shutdown if they don't finish within shutdownTimeout
+	ctx    context.Context
+	cancel context.CancelFunc
+	// jobs are collages and maintenance that Close waits for, no jobs start once closing is set
+	jobsMu          sync.Mutex
+	jobs            sync.WaitGroup
+	closing         bool
+	shutdownTimeout time.Duration
+	// collaging are chats being collaged by the cron or a command, one run per chat at a time
+	collagingMu sync.Mutex
+	collaging   map[int64]struct{}
+	// metricsServer serves metrics if an address is configured
+	metricsServer *http.Server
 }
 
 type AppArgs struct {
-	Token  string
-	DBPath string
-	Server string
+	Token      string
+	DBPath     string
+	Server     string
+	Background color.Color
+	Quality    int
+	MinImages  int
+	// MaxCols limits the width of the collage grid
+	MaxCols int
+	// Cron is the schedule of collages in the standard cron format
+	Cron string
+	// Location is the zone of the schedule and of the days photos are grouped by
+	Location *time.Location
+	// DownloadTimeout limits a single photo download
+	DownloadTimeout time.Duration
+	// DBBusyTimeout is how long a write waits for a locked database, the default if zero
+	DBBusyTimeout time.Duration
+	// DownloadConcurrency limits photos downloaded at the same time
+	DownloadConcurrency int
+	// ChatConcurrency limits chats collaged at the same time
+	ChatConcurrency int
+	// SkipFailedDownloads makes a collage of the rest photos if some fail to download
+	SkipFailedDownloads bool
+	// DryRun builds collages without sending them and keeps the links
+	DryRun bool
+	// MaxImagesPerDay limits photos of a day, unlimited if zero
+	MaxImagesPerDay int
+	// Overflow is the way to limit photos of a day: the most recent ones,
+	// evenly sampled ones or all of them split into collages of MaxImagesPerDay photos
+	Overflow string
+	// MetricsAddr is the address to serve /metrics on, metrics are not served if empty
+	MetricsAddr string
+	// AdminChatID is the chat notified about cron errors, nobody is notified if zero
+	AdminChatID int64
+	// AdminSummary sends stats of every cron run to the admin chat
+	AdminSummary bool
+	// CacheDir is the directory to keep photos in till the collage, photos are not cached if empty
+	CacheDir string
+	// FilenameTemplate is the name of collage files without the extension
+	FilenameTemplate string
 }
 
 func NewAppArgs() (AppArgs, error) {
+	// a secret file keeps the token out of the environment of the process
 	token := os.Getenv("COLLAGIFY_TG_TOKEN")
+	if file := os.Getenv("COLLAGIFY_TG_TOKEN_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return AppArgs{}, fmt.Errorf("read tg token file: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
 	if token == "" {
 		return AppArgs{}, errors.New("empty tg token")
 	}
@@ -57,17 +197,247 @@ func NewAppArgs() (AppArgs, error) {
 		dbPath = tmpDBPath
 	}
 
-	return AppArgs{Token: token, DBPath: dbPath, Server: apiTelegramServer}, nil
+	args := AppArgs{Token: token, DBPath: dbPath, Server: apiTelegramServer}
+
+	if s := os.Getenv("COLLAGIFY_BACKGROUND"); s != "" {
+		c, err := parseColor(s)
+		if err != nil {
+			return AppArgs{}, fmt.Errorf("parse background: %w", err)
+		}
+		args.Background = c
+	}
+
+	if s := os.Getenv("COLLAGIFY_JPEG_QUALITY"); s != "" {
+		q, err := strconv.Atoi(s)
+		if err != nil || q < 1 || q > 100 {
+			return AppArgs{}, fmt.Errorf("invalid jpeg quality %q: must be in range [1, 100]", s)
+		}
+		args.Quality = q
+	}
+
+	args.MinImages = defaultMinImages
+	if s := os.Getenv("COLLAGIFY_MIN_IMAGES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return AppArgs{}, fmt.Errorf("invalid min images %q: must be a positive number", s)
+		}
+		args.MinImages = n
+	}
+
+	args.MaxCols = defaultMaxCols
+	if s := os.Getenv("COLLAGIFY_MAX_COLS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return AppArgs{}, fmt.Errorf("invalid max cols %q: must be a positive number", s)
+		}
+		args.MaxCols = n
+	}
+
+	args.Cron = crontab
+	if s := os.Getenv("COLLAGIFY_CRON"); s != "" {
+		_, err := cron.ParseStandard(s)
+		if err != nil {
+			return AppArgs{}, fmt.Errorf("invalid cron spec %q: %w", s, err)
+		}
+		args.Cron = s
+	}
+
+	args.DownloadTimeout = defaultDownloadTimeout
+	if s := os.Getenv("COLLAGIFY_DOWNLOAD_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return AppArgs{}, fmt.Errorf("invalid download timeout %q: must be a positive duration", s)
+		}
+		args.DownloadTimeout = d
+	}
+
+	if s := os.Getenv("COLLAGIFY_DB_BUSY_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return AppArgs{}, fmt.Errorf("invalid db busy timeout %q: must be a positive duration", s)
+		}
+		args.DBBusyTimeout = d
+	}
+
+	args.DownloadConcurrency = defaultDownloadConcurrency
+	if s := os.Getenv("COLLAGIFY_DOWNLOAD_CONCURRENCY"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return AppArgs{}, fmt.Errorf("invalid download concurrency %q: must be a positive number", s)
+		}
+		args.DownloadConcurrency = n
+	}
+
+	args.ChatConcurrency = defaultChatConcurrency
+	if s := os.Getenv("COLLAGIFY_CHAT_CONCURRENCY"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return AppArgs{}, fmt.Errorf("invalid chat concurrency %q: must be a positive number", s)
+		}
+		args.ChatConcurrency = n
+	}
+
+	if s := os.Getenv("COLLAGIFY_SKIP_FAILED_DOWNLOADS"); s != "" {
+		skip, err := strconv.ParseBool(s)
+		if err != nil {
+			return AppArgs{}, fmt.Errorf("invalid skip failed downloads %q: %w", s, err)
+		}
+		args.SkipFailedDownloads = skip
+	}
+
+	if s := os.Getenv("COLLAGIFY_MAX_IMAGES_PER_DAY"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return AppArgs{}, fmt.Errorf("invalid max images per day %q: must be a positive number", s)
+		}
+		args.MaxImagesPerDay = n
+	}
+
+	args.Overflow = overflowRecent
+	if s := os.Getenv("COLLAGIFY_OVERFLOW"); s != "" {
+		if s != overflowRecent && s != overflowSample && s != overflowPaginate {
+			return AppArgs{}, fmt.Errorf("invalid overflow %q: must be one of %s, %s, %s", s, overflowRecent, overflowSample, overflowPaginate)
+		}
+		args.Overflow = s
+	}
+
+	if s := os.Getenv("COLLAGIFY_DRY_RUN"); s != "" {
+		dryRun, err := strconv.ParseBool(s)
+		if err != nil {
+			return AppArgs{}, fmt.Errorf("invalid dry run %q: %w", s, err)
+		}
+		args.DryRun = dryRun
+	}
+
+	args.FilenameTemplate = defaultFilenameTemplate
+	if s := os.Getenv("COLLAGIFY_FILENAME_TMPL"); s != "" {
+		err := validateFilenameTemplate(s)
+		if err != nil {
+			return AppArgs{}, err
+		}
+		args.FilenameTemplate = s
+	}
+
+	args.MetricsAddr = os.Getenv("COLLAGIFY_METRICS_ADDR")
+	args.CacheDir = os.Getenv("COLLAGIFY_CACHE_DIR")
+
+	if s := os.Getenv("COLLAGIFY_ADMIN_CHAT_ID"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return AppArgs{}, fmt.Errorf("invalid admin chat id %q: %w", s, err)
+		}
+		args.AdminChatID = id
+	}
+
+	if s := os.Getenv("COLLAGIFY_ADMIN_SUMMARY"); s != "" {
+		summary, err := strconv.ParseBool(s)
+		if err != nil {
+			return AppArgs{}, fmt.Errorf("invalid admin summary %q: %w", s, err)
+		}
+		if summary && args.AdminChatID == 0 {
+			return AppArgs{}, errors.New("admin summary needs COLLAGIFY_ADMIN_CHAT_ID")
+		}
+		args.AdminSummary = summary
+	}
+
+	tz := os.Getenv("COLLAGIFY_TZ")
+	if tz == "" {
+		tz = defaultTZ
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return AppArgs{}, fmt.Errorf("load location %q: %w", tz, err)
+	}
+	args.Location = loc
+
+	return args, nil
 }
 
 func New(log *slog.Logger, args AppArgs) (*App, error) {
-	a := &App{log: log, serverURL: args.Server}
-	a.initCron()
-	err := a.initBot(args.Token)
+	a := &App{log: log, serverURL: args.Server, minImages: args.MinImages, loc: args.Location}
+	if a.minImages <= 0 {
+		a.minImages = defaultMinImages
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.collaging = make(map[int64]struct{})
+	a.shutdownTimeout = defaultShutdownTimeout
+	a.maxCols = args.MaxCols
+	if a.maxCols <= 0 {
+		a.maxCols = defaultMaxCols
+	}
+	a.filenameTmpl = args.FilenameTemplate
+	if a.filenameTmpl == "" {
+		a.filenameTmpl = defaultFilenameTemplate
+	}
+	err := validateFilenameTemplate(a.filenameTmpl)
+	if err != nil {
+		return nil, err
+	}
+	a.downloadTimeout = args.DownloadTimeout
+	if a.downloadTimeout == 0 {
+		a.downloadTimeout = defaultDownloadTimeout
+	}
+	a.client = &http.Client{Timeout: a.downloadTimeout}
+	a.downloadBackoff = defaultDownloadBackoff
+	a.downloadConcurrency = args.DownloadConcurrency
+	if a.downloadConcurrency <= 0 {
+		a.downloadConcurrency = defaultDownloadConcurrency
+	}
+	a.chatConcurrency = args.ChatConcurrency
+	if a.chatConcurrency <= 0 {
+		a.chatConcurrency = defaultChatConcurrency
+	}
+	a.skipFailedDownloads = args.SkipFailedDownloads
+	a.dryRun = args.DryRun
+	a.maxImagesPerDay = args.MaxImagesPerDay
+	a.overflow = args.Overflow
+	if a.overflow == "" {
+		a.overflow = overflowRecent
+	}
+	a.adminChatID = args.AdminChatID
+	a.adminSummary = args.AdminSummary && args.AdminChatID != 0
+	if args.CacheDir != "" {
+		cache, err := newFileCache(args.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		a.cache = cache
+	}
+	a.retryAfterUnit = time.Second
+	a.sendBackoff = defaultSendBackoff
+	a.metrics = newMetrics()
+	if args.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", a.metrics)
+		a.metricsServer = &http.Server{Addr: args.MetricsAddr, Handler: mux}
+	}
+	if a.loc == nil {
+		loc, err := time.LoadLocation(defaultTZ)
+		if err != nil {
+			return nil, fmt.Errorf("load location %q: %w", defaultTZ, err)
+		}
+		a.loc = loc
+	}
+	a.collageOpts = append(a.collageOpts,
+		image.WithSkipInvalid(true),
+		image.WithMaxSideSum(telegramMaxSideSum),
+		image.WithMaxAspectRatio(telegramMaxRatio),
+	)
+	if args.Background != nil {
+		a.collageOpts = append(a.collageOpts, image.WithBackground(args.Background))
+	}
+	if args.Quality != 0 {
+		a.collageOpts = append(a.collageOpts, image.WithQuality(args.Quality))
+	}
+	err = a.initCron(args.Cron)
+	if err != nil {
+		return nil, err
+	}
+	err = a.initBot(args.Token)
 	if err != nil {
 		return nil, err
 	}
-	err = a.initDB(args.DBPath)
+	err = a.initDB(args.DBPath, args.DBBusyTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -75,24 +445,55 @@ func New(log *slog.Logger, args AppArgs) (*App, error) {
 	return a, nil
 }
 
-func (a *App) initDB(dbPath string) error {
-	db, err := NewStorage(dbPath)
+func (a *App) initDB(dbPath string, busyTimeout time.Duration) error {
+	db, err := NewStorageContext(a.ctx, dbPath, WithBusyTimeout(busyTimeout))
+	if err != nil {
+		return err
+	}
+	// sql.Open doesn't connect, so a bad path would fail only on the first collage
+	err = db.Ping(a.ctx)
 	if err != nil {
+		db.Close()
 		return err
 	}
 	a.db = db
 	return nil
 }
 
-func (a *App) initCron() {
-	c := cron.New()
-	c.AddFunc(crontab, func() {
+func (a *App) initCron(spec string) error {
+	if spec == "" {
+		spec = crontab
+	}
+
+	c := cron.New(cron.WithLocation(a.loc))
+	id, err := c.AddFunc(spec, func() {
 		err := a.cronHandler()
 		if err != nil {
 			a.log.Error("cron handler", slogerr(err))
 		}
 	})
+	if err != nil {
+		return fmt.Errorf("init cron: %w", err)
+	}
+	a.collageEntry = id
+	a.cronSpec = spec
+
+	_, err = c.AddFunc(maintenanceCrontab, func() {
+		if !a.startJob() {
+			return
+		}
+		defer a.jobs.Done()
+
+		err := a.db.Maintain(a.ctx)
+		if err != nil {
+			a.log.Error("storage maintenance", slogerr(err))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("init maintenance cron: %w", err)
+	}
 	a.crn = c
+	return nil
 }
 
 func (a *App) initBot(token string) error {
@@ -112,12 +513,40 @@ func (a *App) initBot(token string) error {
 }
 
 func (a *App) Start(ctx context.Context) {
+	if a.metricsServer != nil {
+		go func() {
+			err := a.metricsServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				a.log.Error("metrics server", slogerr(err))
+			}
+		}()
+	}
 	a.crn.Start()
 	a.bt.Start(ctx)
 }
 
+// Close waits for running jobs to finish for up to the shutdown timeout,
+// then cancels them and closes the app.
 func (a *App) Close() {
-	a.crn.Stop()
+	stopped := a.crn.Stop()
+	a.jobsMu.Lock()
+	a.closing = true
+	a.jobsMu.Unlock()
+
+	if !a.waitJobs(stopped, a.shutdownTimeout) {
+		a.log.Warn("running jobs are cancelled", slog.Duration("timeout", a.shutdownTimeout))
+	}
+	a.cancel()
+	// cancelled jobs return shortly and must not see the storage closed
+	<-stopped.Done()
+	a.jobs.Wait()
+
+	if a.metricsServer != nil {
+		err := a.metricsServer.Close()
+		if err != nil {
+			a.log.Error("close metrics server", slogerr(err))
+		}
+	}
 	err := a.db.Close()
 	if err != nil {
 		a.log.Error("on close", slogerr(err))
@@ -125,204 +554,1322 @@ func (a *App) Close() {
 }
 
 func (a *App) cronHandler() error {
-	ctx := context.Background()
+	if !a.startJob() {
+		a.log.Info("app is closing, collages are skipped")
+		return nil
+	}
+	defer a.jobs.Done()
 
-	log := a.log.WithGroup("cron")
-	log.Info("cron task start")
+	ctx := a.ctx
 
-	chats, err := a.db.Chats(ctx)
+	a.metrics.cronRuns.Inc()
+	stats := &runStats{}
+	err := a.collageChats(withRunStats(ctx, stats))
 	if err != nil {
-		return err
+		a.metrics.cronErrors.Inc()
+		if a.adminChatID != 0 {
+			notifyErr := a.notifyAdmin(ctx, err)
+			if notifyErr != nil {
+				a.log.Error("notify admin", slogerr(notifyErr))
+			}
+		}
 	}
 
-	log.Debug("chats to range", slog.Any("chats", chats))
-
-	var funcErr error
-	for _, chatID := range chats {
-		messages, toCollage, err := a.db.Links(ctx, chatID)
-		if err != nil {
-			funcErr = errors.Join(funcErr, fmt.Errorf("reading keys by prefix: %w", err))
-			continue
+	if a.adminSummary {
+		summaryErr := a.reply(ctx, a.adminChatID, stats.summary(err))
+		if summaryErr != nil {
+			a.log.Error("send run summary", slogerr(summaryErr))
 		}
+	}
 
-		for _, item := range toCollage {
-			err := a.processCollage(chatID, item)
-			if err != nil {
-				funcErr = errors.Join(funcErr, err)
-				continue
-			}
-		}
+	return err
+}
 
-		err = a.db.DeleteMessages(ctx, messages)
-		if err == nil {
-			err = a.deleteMessages(ctx, chatID, messages)
-		}
-		if err != nil {
-			funcErr = errors.Join(funcErr, err)
-		}
+// runStats are counted during a cron run for the summary sent to the admin chat.
+type runStats struct {
+	chats    counter
+	collages counter
+	images   counter
+}
+
+type runStatsKey struct{}
+
+func withRunStats(ctx context.Context, stats *runStats) context.Context {
+	return context.WithValue(ctx, runStatsKey{}, stats)
+}
+
+// runStatsFrom returns the stats of the run of ctx, the counted ones are dropped
+// if ctx isn't of a cron run.
+func runStatsFrom(ctx context.Context) *runStats {
+	if stats, ok := ctx.Value(runStatsKey{}).(*runStats); ok {
+		return stats
 	}
 
-	return funcErr
+	return &runStats{}
 }
 
-func (a *App) deleteMessages(ctx context.Context, chatID int64, messages []int) error {
-	ok, err := a.bt.DeleteMessages(ctx, &bot.DeleteMessagesParams{
-		ChatID:     chatID,
-		MessageIDs: messages,
-	})
+func (s *runStats) summary(err error) string {
+	errs := 0
 	if err != nil {
-		return fmt.Errorf("delete messages from channel %d: %w", chatID, err)
+		errs = len(flattenErrors(err))
 	}
 
-	if !ok {
-		return fmt.Errorf("unexpected fail to delete messages from channel %d", chatID)
+	return fmt.Sprintf("Collages run finished:\nChats: %d\nCollages sent: %d\nImages downloaded: %d\nErrors: %d",
+		s.chats.v.Load(), s.collages.v.Load(), s.images.v.Load(), errs)
+}
+
+// startJob adds a job for Close to wait for, it reports false if the app is closing
+// and the job must not run. The caller marks the job done with a.jobs.Done.
+func (a *App) startJob() bool {
+	a.jobsMu.Lock()
+	defer a.jobsMu.Unlock()
+
+	if a.closing {
+		return false
+	}
+	a.jobs.Add(1)
+	return true
+}
+
+// waitJobs waits up to the timeout for the jobs of the stopped cron and the started ones
+// and reports whether they finished.
+func (a *App) waitJobs(stopped context.Context, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		<-stopped.Done()
+		a.jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// notifyAdmin sends a summary of the errors to the admin chat.
+func (a *App) notifyAdmin(ctx context.Context, err error) error {
+	text := errorsSummary(err)
+	err = a.retryRateLimited(ctx, func() error {
+		_, err := a.bt.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: a.adminChatID,
+			Text:   text,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("send message to admin chat %d: %w", a.adminChatID, err)
 	}
 
 	return nil
 }
 
-func (a *App) processCollage(chatID int64, item toCollage) error {
-	images := make([][]byte, 0, len(item.links))
-	for _, u := range item.links {
-		resp, err := http.Get(u)
-		if err != nil {
-			return fmt.Errorf("download link %s: %w", u, err)
-		}
-		defer resp.Body.Close()
+// errorsSummary lists the joined errors one per line, only the first maxSummaryErrors
+// of them and each one cut to maxSummaryErrorLen, to fit into a message.
+func errorsSummary(err error) string {
+	errs := flattenErrors(err)
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("reading response body: %w", err)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Collages failed with %d error(s):", len(errs))
+	for i, e := range errs {
+		if i == maxSummaryErrors {
+			fmt.Fprintf(&b, "\n... and %d more", len(errs)-maxSummaryErrors)
+			break
 		}
 
-		images = append(images, body)
+		text := []rune(e.Error())
+		if len(text) > maxSummaryErrorLen {
+			text = append(text[:maxSummaryErrorLen], '…')
+		}
+		b.WriteString("\n- ")
+		b.WriteString(string(text))
 	}
 
-	cols := min(5, len(images))
-	rows := len(images) / cols
-	if len(images)%cols != 0 {
-		rows++
+	return b.String()
+}
+
+// flattenErrors returns the leaves of the errors joined by errors.Join, incremental joins nest.
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
 	}
 
-	collage, err := image.Concat(images, rows, cols)
-	if err != nil {
-		return fmt.Errorf("make collage: %w", err)
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flattenErrors(e)...)
 	}
+	return errs
+}
 
-	_, err = a.bt.SendPhoto(context.TODO(), &bot.SendPhotoParams{
-		ChatID: chatID,
-		Photo: &models.InputFileUpload{
-			Filename: fmt.Sprintf("collage_%s.jpg", item.date),
-			Data:     bytes.NewReader(collage),
-		},
-	})
+// collageChats makes collages of all chats with pending photos.
+func (a *App) collageChats(ctx context.Context) error {
+	log := a.log.WithGroup("cron")
+	log.Info("cron task start")
+
+	// chats without new photos have nothing to collage
+	chats, err := a.db.ChatsWithPending(ctx)
 	if err != nil {
-		return fmt.Errorf("send collage: %w", err)
+		return err
 	}
 
-	return nil
-}
+	log.Debug("chats to range", slog.Any("chats", chats))
 
-func (a *App) botHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	if update.ChannelPost == nil && update.MyChatMember == nil {
-		a.log.Warn("usupported update event", slog.Any("event", *update))
-		return
+	var (
+		mu      sync.Mutex
+		funcErr error
+	)
+	ids := make(chan int64)
+	var wg sync.WaitGroup
+	for range min(a.chatConcurrency, len(chats)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chatID := range ids {
+				runStatsFrom(ctx).chats.Inc()
+				err := a.collageChat(ctx, log, chatID)
+				if err != nil {
+					mu.Lock()
+					funcErr = errors.Join(funcErr, err)
+					mu.Unlock()
+				}
+			}
+		}()
 	}
-
-	if update.ChannelPost != nil {
-		err := a.botHandleChannelPost(ctx, update.ChannelPost)
-		if err != nil {
-			a.log.Error("failed to handle new photo message", slogerr(err))
+feed:
+	for _, chatID := range chats {
+		select {
+		case ids <- chatID:
+		case <-ctx.Done():
+			break feed
 		}
 	}
+	close(ids)
+	wg.Wait()
 
-	if update.MyChatMember != nil {
-		err := a.botHandleMyChatMember(ctx, update.MyChatMember)
-		if err != nil {
-			a.log.Error("failed to handle new chat registration", slogerr(err))
-		}
+	if err := ctx.Err(); err != nil {
+		return errors.Join(funcErr, err)
 	}
-}
 
-func (a *App) botHandleMyChatMember(ctx context.Context, r *models.ChatMemberUpdated) error {
-	return a.db.RegisterChat(ctx, r.Chat.ID, time.Unix(int64(r.Date), 0).In(moscowLoc))
+	return funcErr
 }
 
-func (a *App) botHandleChannelPost(ctx context.Context, m *models.Message) error {
-	if len(m.Photo) == 0 {
-		a.log.Warn("message without photo")
+// collageChat makes collages of the pending photos of the chat unless it's disabled.
+func (a *App) collageChat(ctx context.Context, log *slog.Logger, chatID int64) error {
+	if !a.startCollaging(chatID) {
+		log.Info("chat is being collaged already", slog.Int64("chat", chatID))
 		return nil
 	}
+	defer a.finishCollaging(chatID)
 
-	slices.SortFunc(m.Photo, func(a, b models.PhotoSize) int {
-		return cmp.Compare(a.FileSize, b.FileSize)
-	})
-
-	largestPhoto := m.Photo[len(m.Photo)-1]
-	f, err := a.bt.GetFile(ctx, &bot.GetFileParams{FileID: largestPhoto.FileID})
+	pending, err := a.db.PendingCount(ctx, chatID)
 	if err != nil {
-		return fmt.Errorf("get file info: %w", err)
+		return err
 	}
+	log.Debug("pending links", slog.Int64("chat", chatID), slog.Int("count", pending))
 
-	link := a.bt.FileDownloadLink(f)
-	a.log.Info("download file link", slog.String("url", link))
+	settings, loc, err := a.chatSettings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	if settings.Disabled {
+		log.Debug("chat is disabled", slog.Int64("chat", chatID))
+		return nil
+	}
 
-	err = a.db.RegistreLink(ctx, m.Chat.ID, int64(m.ID), time.Unix(int64(m.Date), 0).In(moscowLoc), link)
+	_, toCollage, err := a.db.Links(ctx, chatID, loc)
+	// nothing was posted since the last run
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("save file link: %w", err)
+		return fmt.Errorf("reading keys by prefix: %w", err)
 	}
 
-	return nil
+	return a.processChat(ctx, log, chatID, toCollage, settings)
 }
 
-func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
-
-	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+// startCollaging marks the chat as being collaged, it reports false if the chat already is.
+func (a *App) startCollaging(chatID int64) bool {
+	a.collagingMu.Lock()
+	defer a.collagingMu.Unlock()
 
-	if BuildTime == "" {
-		BuildTime = "not set"
+	if _, ok := a.collaging[chatID]; ok {
+		return false
 	}
-	log.Info("start", slog.String("build-time", BuildTime))
+	a.collaging[chatID] = struct{}{}
+	return true
+}
 
-	appArgs, err := NewAppArgs()
-	if err != nil {
-		log.Error("init app arguments", slogerr(err))
-		os.Exit(1)
-	}
+func (a *App) finishCollaging(chatID int64) {
+	a.collagingMu.Lock()
+	defer a.collagingMu.Unlock()
+
+	delete(a.collaging, chatID)
+}
 
-	moscowLoc, err = loadLocation()
+// chatSettings returns the settings of the chat with the app defaults in place of unset ones
+// and the zone the days of the chat are grouped by.
+func (a *App) chatSettings(ctx context.Context, chatID int64) (ChatSettings, *time.Location, error) {
+	settings, err := a.db.GetSettings(ctx, chatID)
 	if err != nil {
-		log.Error("loading location 'Europe/Moscow'", slogerr(err))
-		os.Exit(1)
+		return ChatSettings{}, nil, err
 	}
 
-	a, err := New(log, appArgs)
-	if err != nil {
-		log.Error("init app", slogerr(err))
-		os.Exit(1)
+	if settings.MaxCols <= 0 {
+		settings.MaxCols = a.maxCols
+	}
+	if settings.MinImages <= 0 {
+		settings.MinImages = a.minImages
 	}
-	defer a.Close()
 
-	if s := os.Getenv("COLLAGIFY_FLUSH_ON_START"); s != "" {
-		err := a.cronHandler()
+	loc := a.loc
+	if settings.TZ != "" {
+		loc, err = time.LoadLocation(settings.TZ)
 		if err != nil {
-			a.log.Error("flush on start", slogerr(err))
+			return ChatSettings{}, nil, fmt.Errorf("load chat %d location %q: %w", chatID, settings.TZ, err)
 		}
 	}
 
-	a.Start(ctx)
+	return settings, loc, nil
 }
 
-func slogerr(err error) slog.Attr {
-	if err == nil {
-		return slog.Attr{}
-	}
+// processChat makes a collage of each day that has at least settings.MinImages photos
+// and deletes the included messages.
+func (a *App) processChat(ctx context.Context, log *slog.Logger, chatID int64, toCollage []toCollage, settings ChatSettings) error {
+	var (
+		funcErr  error
+		messages []int
+	)
+	for _, item := range toCollage {
+		if err := ctx.Err(); err != nil {
+			funcErr = errors.Join(funcErr, err)
+			break
+		}
 
-	return slog.String("err", err.Error())
-}
+		// small days are left in place to be collaged once they have enough photos
+		if len(item.links) < settings.MinImages {
+			log.Debug("not enough images", slog.Int64("chat", chatID), slog.String("date", item.date), slog.Int("count", len(item.links)))
+			continue
+		}
+
+		// the collage of the day may be already sent by a run that failed to clean up
+		until, err := a.db.CollagedUntil(ctx, chatID, item.date)
+		if err != nil {
+			funcErr = errors.Join(funcErr, err)
+			continue
+		}
+		if !until.IsZero() && item.last <= until.Unix() {
+			log.Info("collage already sent", slog.Int64("chat", chatID), slog.String("date", item.date))
+			messages = append(messages, item.messages...)
+			continue
+		}
+
+		done, err := a.processCollage(ctx, log, chatID, item, settings)
+		if isChatGone(err) && settings.TargetChatID == 0 {
+			// the bot can't post to the chat anymore, so there is nothing to keep
+			log.Warn("chat is gone, unregister it", slog.Int64("chat", chatID), slogerr(err))
+			return a.db.UnregisterChat(ctx, chatID)
+		}
+		if err != nil {
+			funcErr = errors.Join(funcErr, err)
+			continue
+		}
+		messages = append(messages, done...)
+	}
+
+	if len(messages) == 0 || a.dryRun {
+		return funcErr
+	}
+
+	var err error
+	if settings.KeepOriginals {
+		err = a.db.MarkDone(ctx, chatID, messages)
+	} else {
+		err = a.cleanup(ctx, chatID, messages)
+	}
+	if err != nil {
+		funcErr = errors.Join(funcErr, err)
+	}
+
+	return funcErr
+}
+
+// cleanup deletes messages from the storage and the chat. Links are kept
+// in the storage if Telegram fails to delete the messages, so nothing is lost.
+func (a *App) cleanup(ctx context.Context, chatID int64, messages []int) error {
+	// links are deleted after Telegram confirms, the storage isn't locked during the calls
+	err := a.deleteMessages(ctx, chatID, messages)
+	if isChatGone(err) {
+		// the chat is forgotten at all, so there is nothing to keep
+		a.log.Warn("chat is gone, unregister it", slog.Int64("chat", chatID), slogerr(err))
+		return a.db.UnregisterChat(ctx, chatID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return a.db.DeleteMessages(ctx, chatID, messages)
+}
+
+// isChatGone reports whether Telegram failed because the bot can't access the chat anymore:
+// the chat was deleted or the bot was removed from it.
+func isChatGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, bot.ErrorForbidden) {
+		return true
+	}
+
+	return errors.Is(err, bot.ErrorBadRequest) && strings.Contains(err.Error(), "chat not found")
+}
+
+// deleteMessages deletes messages from the chat in batches as Telegram
+// doesn't accept more than maxDeleteMessages per call.
+func (a *App) deleteMessages(ctx context.Context, chatID int64, messages []int) error {
+	var funcErr error
+	for batch := range slices.Chunk(messages, maxDeleteMessages) {
+		var ok bool
+		err := a.retryRateLimited(ctx, func() (err error) {
+			ok, err = a.bt.DeleteMessages(ctx, &bot.DeleteMessagesParams{
+				ChatID:     chatID,
+				MessageIDs: batch,
+			})
+			return err
+		})
+		if err != nil {
+			funcErr = errors.Join(funcErr, fmt.Errorf("delete messages from channel %d: %w", chatID, err))
+			continue
+		}
+
+		if !ok {
+			funcErr = errors.Join(funcErr, fmt.Errorf("unexpected fail to delete messages from channel %d", chatID))
+		}
+	}
+
+	return funcErr
+}
+
+// retryRateLimited calls f again after the delay Telegram asks for while it responds
+// with Too Many Requests, up to rateLimitAttempts times.
+func (a *App) retryRateLimited(ctx context.Context, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		var tooMany *bot.TooManyRequestsError
+		if !errors.As(err, &tooMany) || attempt == rateLimitAttempts {
+			return err
+		}
+		a.log.Warn("rate limited", slog.Int("retry_after", tooMany.RetryAfter), slog.Int("attempt", attempt))
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(time.Duration(tooMany.RetryAfter) * a.retryAfterUnit):
+		}
+	}
+}
+
+// retrySend works like retryRateLimited but also retries network and server errors
+// with exponential backoff until sendAttempts are made.
+func (a *App) retrySend(ctx context.Context, f func() error) error {
+	backoff := a.sendBackoff
+	for attempt := 1; ; attempt++ {
+		err := a.retryRateLimited(ctx, f)
+		if err == nil || attempt == sendAttempts || !isTransient(err) {
+			return err
+		}
+		a.log.Warn("retry send", slog.Int("attempt", attempt), slogerr(err))
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether a Telegram request may succeed if retried.
+// Telegram errors with known codes are caused by the request itself.
+func isTransient(err error) bool {
+	var (
+		tooMany *bot.TooManyRequestsError
+		migrate *bot.MigrateError
+	)
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, bot.ErrorBadRequest), errors.Is(err, bot.ErrorForbidden),
+		errors.Is(err, bot.ErrorUnauthorized), errors.Is(err, bot.ErrorNotFound),
+		errors.Is(err, bot.ErrorConflict),
+		errors.As(err, &tooMany), errors.As(err, &migrate):
+		return false
+	}
+
+	return true
+}
+
+// downloadRetry downloads the link retrying failures with exponential backoff
+// until downloadAttempts are made or the context is done.
+func (a *App) downloadRetry(ctx context.Context, u string) ([]byte, error) {
+	backoff := a.downloadBackoff
+	for attempt := 1; ; attempt++ {
+		body, err := a.download(ctx, u)
+		if err == nil || attempt == downloadAttempts {
+			return body, err
+		}
+		// retries won't fix a client error, but the server may be just overloaded
+		var se *statusError
+		if errors.As(err, &se) && se.code >= 400 && se.code < 500 && se.code != http.StatusTooManyRequests {
+			return nil, err
+		}
+		a.log.Debug("retry download", slog.String("link", u), slog.Int("attempt", attempt), slogerr(err))
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + e.status
+}
+
+// download returns the body of the link, the response is closed before returning.
+func (a *App) download(ctx context.Context, u string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.downloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request %s: %w", u, err)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download link %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download link %s: %w", u, &statusError{code: resp.StatusCode, status: resp.Status})
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+
+	return body, nil
+}
+
+// downloadAll downloads the photos of the day concurrently keeping their order
+// and returns them with the indexes of their links.
+// Failed photos are skipped if the app is configured so, otherwise the first failure is returned.
+func (a *App) downloadAll(ctx context.Context, log *slog.Logger, item toCollage) ([][]byte, []int, error) {
+	bodies := make([][]byte, len(item.links))
+	errs := make([]error, len(item.links))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(a.downloadConcurrency, len(item.links)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if data, ok := a.cache.Get(item.fileIDs[i]); ok {
+					log.Debug("photo is cached", slog.Int("index", i), slog.Int("size", len(data)))
+					bodies[i] = data
+					continue
+				}
+
+				u := a.freshLink(ctx, item.links[i], item.fileIDs[i])
+				bodies[i], errs[i] = a.downloadRetry(ctx, u)
+				if errs[i] != nil {
+					a.metrics.downloadErrors.Inc()
+					log.Warn("photo download failed", slog.Int("index", i), slogerr(errs[i]))
+				} else {
+					a.metrics.imagesDownloaded.Inc()
+					runStatsFrom(ctx).images.Inc()
+					log.Debug("photo downloaded", slog.Int("index", i), slog.Int("size", len(bodies[i])))
+				}
+			}
+		}()
+	}
+feed:
+	for i := range item.links {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	// photos failed because of the cancellation are not worth skipping
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("download photos: %w", err)
+	}
+
+	images := make([][]byte, 0, len(bodies))
+	downloaded := make([]int, 0, len(bodies))
+	for i, err := range errs {
+		if err != nil {
+			if !a.skipFailedDownloads {
+				return nil, nil, err
+			}
+			log.Warn("skipped failed download", slogerr(err))
+			continue
+		}
+		images = append(images, bodies[i])
+		downloaded = append(downloaded, i)
+	}
+
+	return images, downloaded, nil
+}
+
+// processCollage sends the collage of the day and returns the messages of the day
+// that are done with. Messages of photos that failed to download or decode are kept
+// to be collaged by a later run.
+func (a *App) processCollage(ctx context.Context, log *slog.Logger, chatID int64, item toCollage, settings ChatSettings) ([]int, error) {
+	log = log.With(slog.Int64("chat", chatID), slog.String("date", item.date))
+	log.Info("collage start", slog.Int("links", len(item.links)))
+	start := time.Now()
+
+	format, ext, err := collageFormat(settings.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+	opts := append(slices.Clone(a.collageOpts), image.WithFormat(format))
+
+	// photos left out of the collage are evicted as well
+	cached := item.fileIDs
+	pageSize := maxImagesPerCollage
+	if a.maxImagesPerDay > 0 && len(item.links) > a.maxImagesPerDay {
+		log.Warn("too many images", slog.Int("max", a.maxImagesPerDay), slog.String("overflow", a.overflow))
+		if a.overflow == overflowPaginate {
+			pageSize = min(pageSize, a.maxImagesPerDay)
+		} else {
+			item = limitImages(item, a.maxImagesPerDay, a.overflow == overflowSample)
+		}
+	}
+
+	images, indexes, err := a.downloadAll(ctx, log, item)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no photos of %s were downloaded", item.date)
+	}
+
+	var (
+		collages [][]byte
+		count    int
+		// links of the downloaded photos that failed to decode
+		invalid []int
+		offset  int
+	)
+	for page := range slices.Chunk(images, pageSize) {
+		rows, cols := grid(len(page), settings.MaxCols)
+
+		// broken images are skipped and the grid shrinks to the remaining ones
+		buildStart := time.Now()
+		collage, res, err := image.ConcatWithResult(page, rows, cols, opts...)
+		a.metrics.buildDuration.ObserveSince(buildStart)
+		var skipped *image.SkippedError
+		if errors.As(err, &skipped) {
+			log.Warn("skipped invalid images", slogerr(skipped))
+			for _, i := range skipped.Indexes {
+				invalid = append(invalid, indexes[offset+i])
+			}
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("make collage: %w", err)
+		}
+		offset += len(page)
+
+		if res.Relaid {
+			log.Info("collage grid changed to fit telegram limits", slog.Int("rows", res.Rows), slog.Int("cols", res.Cols))
+		}
+		log.Info("collage built",
+			slog.Int("width", res.Width),
+			slog.Int("height", res.Height),
+			slog.Int("cell_width", res.CellWidth),
+			slog.Int("cell_height", res.CellHeight),
+			slog.Int("images", res.Images),
+		)
+
+		collages = append(collages, collage)
+		count += res.Images
+	}
+
+	failed := failedLinks(len(item.links), indexes, invalid)
+	done, last := collagedMessages(item, failed)
+
+	if a.dryRun {
+		log.Info("dry run, collage is not sent", slog.Int("collages", len(collages)), slog.Int("images", count))
+		return done, nil
+	}
+
+	caption := fmt.Sprintf("Photos from %s (%d)", item.date, count)
+	target := chatID
+	if settings.TargetChatID != 0 {
+		target = settings.TargetChatID
+	}
+	name := renderFilename(a.filenameTmpl, chatID, item.date, count)
+	err = a.sendCollages(ctx, target, name, ext, caption, collages, settings.Silent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.cache.Delete(cached...)
+	if err != nil {
+		log.Warn("evict cached photos", slogerr(err))
+	}
+
+	// the collage is already sent, so a missing history record is not a failure
+	err = a.db.AddCollage(ctx, Collage{ChatID: chatID, Date: item.date, ImageCount: count, SentAt: time.Now(), LastLink: time.Unix(last, 0)})
+	if err != nil {
+		log.Error("save collage history", slogerr(err))
+	}
+
+	log.Info("collage sent", slog.Int("images", count), slog.Duration("duration", time.Since(start)))
+	return done, nil
+}
+
+// failedLinks returns the indexes of n links that are neither downloaded nor valid.
+func failedLinks(n int, downloaded, invalid []int) []int {
+	var failed []int
+	for i := range n {
+		if !slices.Contains(downloaded, i) || slices.Contains(invalid, i) {
+			failed = append(failed, i)
+		}
+	}
+
+	return failed
+}
+
+// collagedMessages returns the messages of the day without the ones of the failed links
+// and the time the collage covers the day until. It ends before the first failed link,
+// so the kept photos aren't taken for already collaged ones by the next run.
+func collagedMessages(item toCollage, failed []int) ([]int, int64) {
+	if len(failed) == 0 {
+		return item.messages, item.last
+	}
+
+	last := item.last
+	var kept []int
+	for _, i := range failed {
+		kept = append(kept, item.linkMessages[i]...)
+		last = min(last, item.times[i]-1)
+	}
+
+	var done []int
+	for _, m := range item.messages {
+		if !slices.Contains(kept, m) {
+			done = append(done, m)
+		}
+	}
+
+	return done, last
+}
+
+// collageFormat returns the image format and the file extension of the output format, JPEG if it's empty.
+func collageFormat(format string) (image.Format, string, error) {
+	switch strings.ToLower(format) {
+	case "", outputJPEG:
+		return image.FormatJPEG, ".jpg", nil
+	case outputPNG:
+		return image.FormatPNG, ".png", nil
+	}
+
+	return 0, "", fmt.Errorf("unknown output format %q: must be %s or %s", format, outputJPEG, outputPNG)
+}
+
+// sendCollages sends a single collage as a photo and several ones as albums
+// of up to maxAlbumSize collages, each photo or album is captioned. Files are named
+// after name with page numbers if there are several and the ext extension.
+// Silent collages are sent without a notification.
+func (a *App) sendCollages(ctx context.Context, chatID int64, name, ext, caption string, collages [][]byte, silent bool) error {
+	if len(collages) == 1 {
+		return a.sendCollage(ctx, chatID, name+ext, caption, collages[0], silent)
+	}
+
+	for i := 0; i < len(collages); i += maxAlbumSize {
+		album := collages[i:min(i+maxAlbumSize, len(collages))]
+		// an album needs at least two photos
+		if len(album) == 1 {
+			return a.sendCollage(ctx, chatID, fmt.Sprintf("%s_%d%s", name, i+1, ext), caption, album[0], silent)
+		}
+
+		err := a.retrySend(ctx, func() error {
+			// readers are consumed by an attempt, so the media is made again for a retry
+			media := make([]models.InputMedia, len(album))
+			for j, collage := range album {
+				filename := fmt.Sprintf("%s_%d%s", name, i+j+1, ext)
+				photo := &models.InputMediaPhoto{
+					Media:           "attach://" + filename,
+					MediaAttachment: bytes.NewReader(collage),
+				}
+				// the caption of the first photo is shown as the album one
+				if j == 0 {
+					photo.Caption = caption
+				}
+				media[j] = photo
+			}
+
+			_, err := a.bt.SendMediaGroup(ctx, &bot.SendMediaGroupParams{ChatID: chatID, Media: media, DisableNotification: silent})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("send collages album: %w", err)
+		}
+		for range album {
+			a.metrics.collagesSent.Inc()
+			runStatsFrom(ctx).collages.Inc()
+		}
+	}
+
+	return nil
+}
+
+func (a *App) sendCollage(ctx context.Context, chatID int64, filename, caption string, collage []byte, silent bool) error {
+	err := a.retrySend(ctx, func() error {
+		_, err := a.bt.SendPhoto(ctx, &bot.SendPhotoParams{
+			ChatID:              chatID,
+			Caption:             caption,
+			DisableNotification: silent,
+			Photo: &models.InputFileUpload{
+				Filename: filename,
+				Data:     bytes.NewReader(collage),
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("send collage: %w", err)
+	}
+	a.metrics.collagesSent.Inc()
+	runStatsFrom(ctx).collages.Inc()
+
+	return nil
+}
+
+// freshLink returns a new download link for the file as stored links expire
+// in about an hour. The stored link is returned if the file can't be resolved.
+func (a *App) freshLink(ctx context.Context, link, fileID string) string {
+	if fileID == "" {
+		return link
+	}
+
+	f, err := a.bt.GetFile(ctx, &bot.GetFileParams{FileID: fileID})
+	if err != nil {
+		a.log.Warn("resolve file link", slog.String("file_id", fileID), slogerr(err))
+		return link
+	}
+
+	return a.fileLink(f)
+}
+
+// fileLink returns the download link of the file. Telegram file paths may be nested,
+// like photos/file_1.jpg, so every segment is escaped on its own keeping the slashes.
+func (a *App) fileLink(f *models.File) string {
+	segments := strings.Split(f.FilePath, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return a.bt.FileDownloadLink(&models.File{FilePath: strings.Join(segments, "/")})
+}
+
+func (a *App) botHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.ChannelPost == nil && update.Message == nil && update.MyChatMember == nil {
+		a.log.Warn("usupported update event", slog.Any("event", *update))
+		return
+	}
+
+	if update.ChannelPost != nil {
+		var err error
+		if isCommand(update.ChannelPost) {
+			err = a.botHandleCommand(ctx, update.ChannelPost)
+		} else {
+			err = a.botHandleChannelPost(ctx, update.ChannelPost)
+		}
+		if err != nil {
+			a.log.Error("failed to handle new photo message", slogerr(err))
+		}
+	}
+
+	if update.Message != nil {
+		err := a.botHandleMessage(ctx, update.Message)
+		if err != nil {
+			a.log.Error("failed to handle new group message", slogerr(err))
+		}
+	}
+
+	if update.MyChatMember != nil {
+		err := a.botHandleMyChatMember(ctx, update.MyChatMember)
+		if err != nil {
+			a.log.Error("failed to handle new chat registration", slogerr(err))
+		}
+	}
+}
+
+func (a *App) botHandleMyChatMember(ctx context.Context, r *models.ChatMemberUpdated) error {
+	return a.db.RegisterChat(ctx, r.Chat.ID, time.Unix(int64(r.Date), 0).In(a.loc))
+}
+
+// botHandleMessage handles messages of group chats the same way as channel posts.
+// Private chats are ignored, a collage is made for a whole group only.
+func (a *App) botHandleMessage(ctx context.Context, m *models.Message) error {
+	if m.Chat.Type != chatTypeGroup && m.Chat.Type != chatTypeSupergroup {
+		a.log.Warn("message from unsupported chat type", slog.String("type", m.Chat.Type))
+		return nil
+	}
+
+	if isCommand(m) {
+		return a.botHandleCommand(ctx, m)
+	}
+
+	return a.botHandleChannelPost(ctx, m)
+}
+
+func isCommand(m *models.Message) bool {
+	return strings.HasPrefix(m.Text, "/")
+}
+
+// parseCommand splits a command message into the command name without
+// the leading slash and the bot mention, and its arguments.
+func parseCommand(text string) (cmd, args string) {
+	cmd, args, _ = strings.Cut(strings.TrimSpace(text), " ")
+	cmd, _, _ = strings.Cut(strings.TrimPrefix(cmd, "/"), "@")
+	return strings.ToLower(cmd), strings.TrimSpace(args)
+}
+
+func (a *App) botHandleCommand(ctx context.Context, m *models.Message) error {
+	cmd, args := parseCommand(m.Text)
+	switch cmd {
+	case "collage":
+		return a.botHandleCollageCommand(ctx, m, args)
+	case "stats":
+		return a.botHandleStatsCommand(ctx, m.Chat.ID)
+	case "cols":
+		return a.botHandleColsCommand(ctx, m, args)
+	case "help":
+		return a.botHandleHelpCommand(ctx, m.Chat.ID)
+	default:
+		a.log.Warn("unsupported command", slog.String("command", cmd))
+		return nil
+	}
+}
+
+// NextRun returns the time of the next scheduled collages.
+func (a *App) NextRun() time.Time {
+	// schedules without a zone are in the zone of the given time like the cron runs them
+	return a.crn.Entry(a.collageEntry).Schedule.Next(time.Now().In(a.loc))
+}
+
+// botHandleStatsCommand replies with the number of pending photos, the date of the oldest one
+// and the time of the next collage.
+func (a *App) botHandleStatsCommand(ctx context.Context, chatID int64) error {
+	_, loc, err := a.chatSettings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+
+	pending, err := a.db.PendingCount(ctx, chatID)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Pending photos: %d", pending)
+	if pending > 0 {
+		oldest, err := a.db.OldestLink(ctx, chatID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "\nOldest photo: %s", oldest.In(loc).Format(time.DateOnly))
+	}
+	fmt.Fprintf(&b, "\nNext collage: %s", a.NextRun().In(loc).Format("2006-01-02 15:04 MST"))
+
+	err = a.reply(ctx, chatID, b.String())
+	if err != nil {
+		return fmt.Errorf("send stats: %w", err)
+	}
+
+	return nil
+}
+
+// botHandleColsCommand sets the maximum number of collage columns of the chat.
+func (a *App) botHandleColsCommand(ctx context.Context, m *models.Message, args string) error {
+	chatID := m.Chat.ID
+	admin, err := a.isAdmin(ctx, m)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return a.reply(ctx, chatID, "Only chat administrators can change the settings")
+	}
+
+	cols, err := strconv.Atoi(args)
+	if err != nil || cols < minColsSetting || cols > maxColsSetting {
+		return a.reply(ctx, chatID, fmt.Sprintf("Usage: /cols N, where N is from %d to %d", minColsSetting, maxColsSetting))
+	}
+
+	settings, err := a.db.GetSettings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	settings.MaxCols = cols
+	err = a.db.SetSettings(ctx, chatID, settings)
+	if err != nil {
+		return err
+	}
+
+	err = a.reply(ctx, chatID, fmt.Sprintf("Collages will have up to %d columns", cols))
+	if err != nil {
+		return fmt.Errorf("send cols confirmation: %w", err)
+	}
+
+	return nil
+}
+
+// botHandleHelpCommand replies with what the bot does, when, and the commands it knows.
+func (a *App) botHandleHelpCommand(ctx context.Context, chatID int64) error {
+	_, loc, err := a.chatSettings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "I make a collage of the photos posted here for every day and send it on schedule %q in %s time, the next one is at %s.",
+		a.cronSpec, a.loc, a.NextRun().In(loc).Format("2006-01-02 15:04 MST"))
+	fmt.Fprintf(&b, "\nPhotos are grouped by days in %s time.", loc)
+	b.WriteString("\n\nCommands:")
+	b.WriteString("\n/collage - make collages of the pending photos now, /collage today for today's photos only, admins only")
+	b.WriteString("\n/stats - show the number of pending photos and the time of the next collage")
+	fmt.Fprintf(&b, "\n/cols N - make collages with up to N columns, from %d to %d, admins only", minColsSetting, maxColsSetting)
+	b.WriteString("\n/help - show this message")
+
+	err = a.reply(ctx, chatID, b.String())
+	if err != nil {
+		return fmt.Errorf("send help: %w", err)
+	}
+
+	return nil
+}
+
+// isAdmin reports whether the message is sent by an administrator of its chat.
+// Messages sent on behalf of the chat itself, like channel posts and messages
+// of anonymous group admins, are sent by administrators only.
+func (a *App) isAdmin(ctx context.Context, m *models.Message) (bool, error) {
+	if m.SenderChat != nil {
+		return m.SenderChat.ID == m.Chat.ID, nil
+	}
+	if m.From == nil {
+		return false, nil
+	}
+
+	member, err := a.bt.GetChatMember(ctx, &bot.GetChatMemberParams{ChatID: m.Chat.ID, UserID: m.From.ID})
+	if err != nil {
+		return false, fmt.Errorf("get chat member %d: %w", m.From.ID, err)
+	}
+
+	return member.Type == models.ChatMemberTypeOwner || member.Type == models.ChatMemberTypeAdministrator, nil
+}
+
+func (a *App) reply(ctx context.Context, chatID int64, text string) error {
+	return a.retryRateLimited(ctx, func() error {
+		_, err := a.bt.SendMessage(ctx, &bot.SendMessageParams{ChatID: chatID, Text: text})
+		return err
+	})
+}
+
+// botHandleCollageCommand makes collages of the chat right away, of today's photos
+// only if args is "today". Unlike the cron, days with fewer photos than the minimum are collaged too.
+// Only chat administrators can run it, as it deletes the pending photos.
+func (a *App) botHandleCollageCommand(ctx context.Context, m *models.Message, args string) error {
+	if !a.startJob() {
+		return nil
+	}
+	defer a.jobs.Done()
+
+	chatID := m.Chat.ID
+	admin, err := a.isAdmin(ctx, m)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return a.reply(ctx, chatID, "Only chat administrators can make collages")
+	}
+	if args != "" && args != "today" {
+		return a.reply(ctx, chatID, "Usage: /collage or /collage today")
+	}
+
+	// the cron may be collaging the chat right now
+	if !a.startCollaging(chatID) {
+		return a.reply(ctx, chatID, "Collages of the chat are being made already")
+	}
+	defer a.finishCollaging(chatID)
+
+	settings, loc, err := a.chatSettings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+
+	var toCollage []toCollage
+	switch args {
+	case "today":
+		now := time.Now().In(loc)
+		year, month, day := now.Date()
+		_, toCollage, err = a.db.LinksBetween(ctx, chatID, loc, time.Date(year, month, day, 0, 0, 0, 0, loc), now)
+	default:
+		_, toCollage, err = a.db.Links(ctx, chatID, loc)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading links: %w", err)
+	}
+
+	settings.MinImages = 1
+	return a.processChat(ctx, a.log.WithGroup("command"), chatID, toCollage, settings)
+}
+
+func (a *App) botHandleChannelPost(ctx context.Context, m *models.Message) error {
+	photos := messagePhotos(m)
+	if len(photos) == 0 {
+		a.log.Warn("message without photo")
+		return nil
+	}
+
+	// telegram sometimes reports zero file sizes, so equal ones are sorted by resolution
+	slices.SortStableFunc(photos, func(a, b models.PhotoSize) int {
+		return cmp.Or(
+			cmp.Compare(a.FileSize, b.FileSize),
+			cmp.Compare(a.Width*a.Height, b.Width*b.Height),
+		)
+	})
+
+	largestPhoto, f, err := a.largestFile(ctx, photos)
+	if err != nil {
+		return err
+	}
+
+	link := a.fileLink(f)
+	a.log.Info("download file link", slog.String("url", link))
+
+	err = a.db.RegistreLink(ctx, Link{
+		ChatID:       m.Chat.ID,
+		MessageID:    int64(m.ID),
+		Date:         time.Unix(int64(m.Date), 0).In(a.loc),
+		URL:          link,
+		Caption:      m.Caption,
+		FileID:       largestPhoto.FileID,
+		MediaGroupID: m.MediaGroupID,
+		Width:        largestPhoto.Width,
+		Height:       largestPhoto.Height,
+		FileSize:     largestPhoto.FileSize,
+	})
+	if err != nil {
+		return fmt.Errorf("save file link: %w", err)
+	}
+
+	if a.cache != nil {
+		a.cachePhoto(ctx, largestPhoto.FileID, link)
+	}
+
+	return nil
+}
+
+// messagePhotos returns the photo sizes of the message,
+// videos and animations are collaged as their thumbnails.
+func messagePhotos(m *models.Message) []models.PhotoSize {
+	switch {
+	case len(m.Photo) > 0:
+		return m.Photo
+	case m.Video != nil && m.Video.Thumbnail != nil:
+		return []models.PhotoSize{*m.Video.Thumbnail}
+	case m.Animation != nil && m.Animation.Thumbnail != nil:
+		return []models.PhotoSize{*m.Animation.Thumbnail}
+	}
+
+	return nil
+}
+
+// largestFile returns the largest of the photo sizes sorted by file size that bots can download,
+// falling back to smaller ones if Telegram refuses too big files.
+func (a *App) largestFile(ctx context.Context, sizes []models.PhotoSize) (models.PhotoSize, *models.File, error) {
+	for i := len(sizes) - 1; i >= 0; i-- {
+		f, err := a.bt.GetFile(ctx, &bot.GetFileParams{FileID: sizes[i].FileID})
+		if err == nil {
+			if i < len(sizes)-1 {
+				a.log.Info("smaller photo size is used", slog.Int("width", sizes[i].Width), slog.Int("height", sizes[i].Height))
+			}
+			return sizes[i], f, nil
+		}
+		if !isFileTooBig(err) {
+			return models.PhotoSize{}, nil, fmt.Errorf("get file info: %w", err)
+		}
+		a.log.Warn("photo size is too big", slog.Int("width", sizes[i].Width), slog.Int("height", sizes[i].Height), slogerr(err))
+	}
+
+	return models.PhotoSize{}, nil, errors.New("get file info: all photo sizes are too big")
+}
+
+// isFileTooBig reports whether Telegram failed to get a file over the bot download limit.
+func isFileTooBig(err error) bool {
+	return errors.Is(err, bot.ErrorBadRequest) && strings.Contains(err.Error(), "file is too big")
+}
+
+// cachePhoto downloads the photo to the cache, the photo is downloaded
+// with the collage later if it fails.
+func (a *App) cachePhoto(ctx context.Context, fileID, link string) {
+	data, err := a.downloadRetry(ctx, link)
+	if err == nil {
+		err = a.cache.Put(fileID, data)
+	}
+	if err != nil {
+		a.log.Warn("cache photo", slog.String("file_id", fileID), slogerr(err))
+	}
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	if BuildTime == "" {
+		BuildTime = "not set"
+	}
+	log.Info("start", slog.String("build-time", BuildTime))
+
+	appArgs, err := NewAppArgs()
+	if err != nil {
+		log.Error("init app arguments", slogerr(err))
+		os.Exit(1)
+	}
+
+	a, err := New(log, appArgs)
+	if err != nil {
+		log.Error("init app", slogerr(err))
+		os.Exit(1)
+	}
+	defer a.Close()
+
+	if s := os.Getenv("COLLAGIFY_FLUSH_ON_START"); s != "" {
+		err := a.cronHandler()
+		if err != nil {
+			a.log.Error("flush on start", slogerr(err))
+		}
+	}
+
+	a.Start(ctx)
+}
+
+func slogerr(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+
+	return slog.String("err", err.Error())
+}
+
+// limitImages keeps n photos of the day, the most recent ones or evenly sampled ones.
+func limitImages(item toCollage, n int, sample bool) toCollage {
+	indexes := make([]int, n)
+	for i := range indexes {
+		if sample {
+			indexes[i] = i * len(item.links) / n
+		} else {
+			indexes[i] = len(item.links) - n + i
+		}
+	}
+
+	limited := item
+	limited.links = make([]string, n)
+	limited.captions = make([]string, n)
+	limited.fileIDs = make([]string, n)
+	limited.mediaGroups = make([]string, n)
+	limited.linkMessages = make([][]int, n)
+	limited.times = make([]int64, n)
+	for i, j := range indexes {
+		limited.links[i] = item.links[j]
+		limited.captions[i] = item.captions[j]
+		limited.fileIDs[i] = item.fileIDs[j]
+		limited.mediaGroups[i] = item.mediaGroups[j]
+		limited.linkMessages[i] = item.linkMessages[j]
+		limited.times[i] = item.times[j]
+	}
+
+	return limited
+}
+
+// grid returns a near-square grid for n images that is not wider than maxCols.
+func grid(n, maxCols int) (rows, cols int) {
+	rows, cols = image.GridFor(n)
+	if cols > maxCols {
+		cols = maxCols
+		rows = (n + cols - 1) / cols
+	}
+
+	return rows, cols
+}
+
+var filenamePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// validateFilenameTemplate checks the template has only known placeholders
+// and makes a valid file name.
+func validateFilenameTemplate(tmpl string) error {
+	for _, p := range filenamePlaceholder.FindAllString(tmpl, -1) {
+		if p != "{chat}" && p != "{date}" && p != "{count}" {
+			return fmt.Errorf("invalid filename template %q: unknown placeholder %s", tmpl, p)
+		}
+	}
+	if strings.ContainsAny(tmpl, `/\`) {
+		return fmt.Errorf("invalid filename template %q: must not contain path separators", tmpl)
+	}
+
+	return nil
+}
+
+func renderFilename(tmpl string, chatID int64, date string, count int) string {
+	return strings.NewReplacer(
+		"{chat}", strconv.FormatInt(chatID, 10),
+		"{date}", date,
+		"{count}", strconv.Itoa(count),
+	).Replace(tmpl)
+}
+
+// parseColor parses a hex color in the form of RRGGBB or RRGGBBAA, optionally prefixed with '#'.
+func parseColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 && len(s) != 8 {
+		return nil, fmt.Errorf("invalid color %q", s)
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color %q: %w", s, err)
+	}
 
-func loadLocation() (*time.Location, error) {
-	return time.LoadLocation("Europe/Moscow")
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
 }
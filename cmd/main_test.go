@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	stdimage "image"
+	"image/color"
 	"io"
 	"log/slog"
 	"mime"
@@ -14,10 +17,14 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"github.com/matryer/is"
 )
@@ -25,60 +32,1919 @@ import (
 func TestApp(t *testing.T) {
 	is := is.New(t)
 
-	loc, err := loadLocation()
+	app, server := newTestApp(t, is)
+	loc := app.loc
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat: models.Chat{ID: 1337},
+		Date: int(time.Date(2024, time.August, 31, 14, 19, 0, 0, loc).Unix()),
+		Photo: []models.PhotoSize{
+			{FileID: "red.jpeg", FileSize: 10},
+			{FileID: "fake.jpeg", FileSize: 2},
+		},
+		ID: 8,
+	})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat: models.Chat{ID: 1337},
+		Date: int(time.Date(2024, time.September, 1, 13, 11, 0, 0, loc).Unix()),
+		Photo: []models.PhotoSize{
+			{FileID: "green.jpeg", FileSize: 10},
+			{FileID: "fake.jpeg", FileSize: 2},
+		},
+		ID: 9,
+	})
+	is.NoErr(err)
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-08-31.jpg", "collage_2024-09-01.jpg"}, server.sentPhotos)
+	is.Equal("[8,9]", server.deletedMessages)
+	is.Equal([]string{"Photos from 2024-08-31 (1)", "Photos from 2024-09-01 (1)"}, server.sentCaptions)
+
+	history, err := app.db.CollageHistory(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(2, len(history))
+	is.Equal("2024-09-01", history[0].Date)
+	is.Equal(1, history[0].ImageCount)
+	is.Equal("2024-08-31", history[1].Date)
+
+	messages, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.Equal(0, len(messages))
+	is.Equal(0, len(toCollage))
+	is.Equal(sql.ErrNoRows, err)
+}
+
+func TestGrid(t *testing.T) {
+	is := is.New(t)
+
+	tests := []struct {
+		n, rows, cols int
+	}{
+		{1, 1, 1},
+		{6, 2, 3},
+		{7, 3, 3},
+		{26, 6, 5},
+	}
+	for _, tt := range tests {
+		rows, cols := grid(tt.n, 5)
+		is.Equal(tt.rows, rows)
+		is.Equal(tt.cols, cols)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	is := is.New(t)
+
+	c, err := parseColor("#000000")
+	is.NoErr(err)
+	is.Equal(color.NRGBA{A: 255}, c)
+
+	c, err = parseColor("ff880080")
+	is.NoErr(err)
+	is.Equal(color.NRGBA{R: 255, G: 136, A: 128}, c)
+
+	_, err = parseColor("#fff")
+	is.True(err != nil)
+
+	_, err = parseColor("zzzzzz")
+	is.True(err != nil)
+}
+
+func TestAppCollagesChatsConcurrently(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.ChatConcurrency = 2 })
+
+	chats := []int64{1337, 42, 43, 44, 45}
+	for i, chatID := range chats {
+		err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: chatID}})
+		is.NoErr(err)
+
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: chatID},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+	// chats with broken settings fail on their own
+	is.NoErr(app.db.SetSettings(context.TODO(), 43, ChatSettings{TZ: "Mars/Olympus"}))
+	is.NoErr(app.db.SetSettings(context.TODO(), 45, ChatSettings{TZ: "Venus/Maxwell"}))
+
+	err := app.cronHandler()
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "Mars/Olympus"))  // errors of all chats are reported
+	is.True(strings.Contains(err.Error(), "Venus/Maxwell")) // errors of all chats are reported
+
+	sent := slices.Clone(server.sentChats)
+	slices.Sort(sent)
+	is.Equal([]string{"1337", "42", "44"}, sent)
+
+	for _, chatID := range []int64{1337, 42, 44} {
+		pending, err := app.db.PendingCount(context.TODO(), chatID)
+		is.NoErr(err)
+		is.Equal(0, pending)
+	}
+	for _, chatID := range []int64{43, 45} {
+		pending, err := app.db.PendingCount(context.TODO(), chatID)
+		is.NoErr(err)
+		is.Equal(1, pending)
+	}
+}
+
+func TestAppSplitsLargeDays(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	for i := range maxImagesPerCollage + 3 {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: fmt.Sprintf("%d/red.jpeg", i), FileSize: 10}},
+			ID:    i + 1,
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(0, len(server.sentPhotos))
+	is.Equal([][]string{{"collage_2024-08-31_1.jpg", "collage_2024-08-31_2.jpg"}}, server.sentAlbums)
+	is.Equal([]string{fmt.Sprintf("Photos from 2024-08-31 (%d)", maxImagesPerCollage+3)}, server.sentCaptions)
+}
+
+func TestAppSendCollagesAlbums(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	collage, err := os.ReadFile("testdata/red.jpeg")
+	is.NoErr(err)
+
+	collages := make([][]byte, 21)
+	for i := range collages {
+		collages[i] = collage
+	}
+
+	err = app.sendCollages(context.TODO(), 1337, "collage_2024-08-31", ".jpg", "", collages, false)
+	is.NoErr(err)
+	is.Equal(2, len(server.sentAlbums))
+	is.Equal(10, len(server.sentAlbums[0]))
+	is.Equal("collage_2024-08-31_11.jpg", server.sentAlbums[1][0])
+	// the rest photo can't be an album
+	is.Equal([]string{"collage_2024-08-31_21.jpg"}, server.sentPhotos)
+}
+
+func TestAppFilenameTemplate(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("COLLAGIFY_TG_TOKEN", "1")
+	t.Setenv("COLLAGIFY_FILENAME_TMPL", "food_{day}")
+	_, err := NewAppArgs()
+	is.True(err != nil)
+
+	t.Setenv("COLLAGIFY_FILENAME_TMPL", "../{date}")
+	_, err = NewAppArgs()
+	is.True(err != nil)
+
+	t.Setenv("COLLAGIFY_FILENAME_TMPL", "food_{chat}_{date}_{count}")
+	args, err := NewAppArgs()
+	is.NoErr(err)
+
+	app, server := newTestApp(t, is, func(a *AppArgs) { a.FilenameTemplate = args.FilenameTemplate })
+
+	err = app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+	for i, file := range []string{"red.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"food_1337_2024-08-31_2.jpg"}, server.sentPhotos)
+}
+
+func TestAppMaxImagesPerDay(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("COLLAGIFY_TG_TOKEN", "1")
+	t.Setenv("COLLAGIFY_OVERFLOW", "drop")
+	_, err := NewAppArgs()
+	is.True(err != nil)
+
+	for _, tt := range []struct {
+		overflow string
+		photos   []string
+		albums   [][]string
+		caption  string
+	}{
+		{overflowRecent, []string{"collage_2024-08-31.jpg"}, nil, "Photos from 2024-08-31 (4)"},
+		{overflowSample, []string{"collage_2024-08-31.jpg"}, nil, "Photos from 2024-08-31 (4)"},
+		{overflowPaginate, nil, [][]string{{"collage_2024-08-31_1.jpg", "collage_2024-08-31_2.jpg"}}, "Photos from 2024-08-31 (6)"},
+	} {
+		app, server := newTestApp(t, is, func(args *AppArgs) {
+			args.MaxImagesPerDay = 4
+			args.Overflow = tt.overflow
+		})
+
+		err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+		is.NoErr(err)
+		for i := range 6 {
+			err = app.botHandleChannelPost(context.TODO(), &models.Message{
+				ID:    i + 1,
+				Chat:  models.Chat{ID: 1337},
+				Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+				Photo: []models.PhotoSize{{FileID: fmt.Sprintf("%d/red.jpeg", i), FileSize: 10}},
+			})
+			is.NoErr(err)
+		}
+
+		err = app.cronHandler()
+		is.NoErr(err)
+		is.Equal(tt.photos, server.sentPhotos)
+		is.Equal(tt.albums, server.sentAlbums)
+		is.Equal([]string{tt.caption}, server.sentCaptions)
+
+		// the rest photos are cleaned up too
+		_, _, err = app.db.Links(context.TODO(), 1337, app.loc)
+		is.True(errors.Is(err, sql.ErrNoRows))
+	}
+}
+
+func TestLimitImages(t *testing.T) {
+	is := is.New(t)
+
+	item := toCollage{
+		links:        []string{"0", "1", "2", "3", "4", "5"},
+		captions:     make([]string, 6),
+		fileIDs:      []string{"f0", "f1", "f2", "f3", "f4", "f5"},
+		mediaGroups:  make([]string, 6),
+		linkMessages: [][]int{{10}, {11}, {12}, {13}, {14}, {15}},
+		times:        []int64{100, 101, 102, 103, 104, 105},
+	}
+
+	recent := limitImages(item, 4, false)
+	is.Equal([]string{"2", "3", "4", "5"}, recent.links)
+	is.Equal([]string{"f2", "f3", "f4", "f5"}, recent.fileIDs)
+
+	sampled := limitImages(item, 3, true)
+	is.Equal([]string{"0", "2", "4"}, sampled.links)
+	is.Equal([]string{"f0", "f2", "f4"}, sampled.fileIDs)
+	is.Equal([][]int{{10}, {12}, {14}}, sampled.linkMessages)
+	is.Equal([]int64{100, 102, 104}, sampled.times)
+}
+
+func TestAppSilent(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	for _, chatID := range []int64{1337, 42} {
+		err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: chatID}})
+		is.NoErr(err)
+		for i, file := range []string{"red.jpeg", "green.jpeg"} {
+			err = app.botHandleChannelPost(context.TODO(), &models.Message{
+				ID:    int(chatID) + i,
+				Chat:  models.Chat{ID: chatID},
+				Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+				Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+			})
+			is.NoErr(err)
+		}
+	}
+	is.NoErr(app.db.SetSettings(context.TODO(), 1337, ChatSettings{Silent: true}))
+
+	err := app.cronHandler()
+	is.NoErr(err)
+	is.Equal(2, len(server.sentChats))
+	for i, chatID := range server.sentChats {
+		if chatID == "1337" {
+			is.Equal("true", server.silentSends[i])
+		} else {
+			is.Equal("", server.silentSends[i])
+		}
+	}
+}
+
+func TestAppOutputFormat(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	for _, chatID := range []int64{1337, 42} {
+		err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: chatID}})
+		is.NoErr(err)
+		for i, file := range []string{"red.jpeg", "green.jpeg"} {
+			err = app.botHandleChannelPost(context.TODO(), &models.Message{
+				ID:    int(chatID) + i,
+				Chat:  models.Chat{ID: chatID},
+				Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+				Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+			})
+			is.NoErr(err)
+		}
+	}
+	is.NoErr(app.db.SetSettings(context.TODO(), 1337, ChatSettings{OutputFormat: "png"}))
+
+	err := app.cronHandler()
+	is.NoErr(err)
+	is.Equal(2, len(server.sentChats))
+	for i, chatID := range server.sentChats {
+		if chatID == "1337" {
+			is.Equal("collage_2024-08-31.png", server.sentPhotos[i])
+			is.Equal("png", server.sentFormats[i])
+		} else {
+			is.Equal("collage_2024-08-31.jpg", server.sentPhotos[i])
+			is.Equal("jpeg", server.sentFormats[i])
+		}
+	}
+
+	// unknown formats fail the chat only
+	is.NoErr(app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:    2000,
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.September, 1, 14, 0, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+	}))
+	is.NoErr(app.db.SetSettings(context.TODO(), 1337, ChatSettings{OutputFormat: "bmp"}))
+	err = app.cronHandler()
+	is.True(err != nil)
+	is.Equal(2, len(server.sentPhotos))
+}
+
+func TestAppKeepOriginals(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+	is.NoErr(app.db.SetSettings(context.TODO(), 1337, ChatSettings{KeepOriginals: true}))
+
+	for i, file := range []string{"red.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+	is.Equal(0, server.deleteCalls)
+
+	// the links are kept but not collaged again
+	var done int
+	is.NoErr(app.db.db.QueryRow(`select count(*) from links where chat_id = 1337 and done = 1`).Scan(&done))
+	is.Equal(2, done)
+
+	pending, err := app.db.PendingCount(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(0, pending)
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(1, len(server.sentPhotos))
+}
+
+func TestAppDryRun(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("COLLAGIFY_TG_TOKEN", "1")
+	t.Setenv("COLLAGIFY_DRY_RUN", "yes")
+	_, err := NewAppArgs()
+	is.True(err != nil)
+
+	t.Setenv("COLLAGIFY_DRY_RUN", "true")
+	args, err := NewAppArgs()
+	is.NoErr(err)
+	is.True(args.DryRun)
+
+	app, server := newTestApp(t, is, func(a *AppArgs) { a.DryRun = args.DryRun })
+
+	err = app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+	for i, file := range []string{"red.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(0, len(server.sentPhotos))
+	is.Equal(0, server.deleteCalls)
+
+	messages, _, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal([]int{1, 2}, messages)
+}
+
+func TestAppKeepsLinksWhenDeleteFails(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	server.failDelete = true
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+		ID:    8,
+	})
+	is.NoErr(err)
+
+	err = app.cronHandler()
+	is.True(err != nil)
+
+	messages, _, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal([]int{8}, messages)
+}
+
+func TestAppStorageNotLockedDuringDelete(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+		ID:    8,
+	})
+	is.NoErr(err)
+
+	// a photo posted while Telegram deletes the collaged ones is registered right away
+	server.onDelete = func() {
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() {
+			done <- app.db.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 9, Date: time.Now(), URL: "http://a"})
+		}()
+		select {
+		case err := <-done:
+			is.NoErr(err)
+		case <-ctx.Done():
+			t.Error("storage is locked while messages are deleted")
+		}
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal("[8]", server.deletedMessages)
+
+	pending, err := app.db.PendingCount(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(1, pending)
+}
+
+func TestAppDoesNotResendAfterDeleteFails(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	server.failDelete = true
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+		ID:    8,
+	})
+	is.NoErr(err)
+
+	err = app.cronHandler()
+	is.True(err != nil)
+	is.Equal(1, len(server.sentPhotos))
+
+	server.failDelete = false
+	err = app.cronHandler()
+	is.NoErr(err)
+	// the day is only cleaned up
+	is.Equal(1, len(server.sentPhotos))
+	is.Equal("[8]", server.deletedMessages)
+
+	_, _, err = app.db.Links(context.TODO(), 1337, app.loc)
+	is.True(errors.Is(err, sql.ErrNoRows))
+
+	// photos posted later for the same day make a new collage
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 18, 0, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "green.jpeg", FileSize: 10}},
+		ID:    9,
+	})
+	is.NoErr(err)
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(2, len(server.sentPhotos))
+}
+
+func TestAppCache(t *testing.T) {
+	is := is.New(t)
+
+	cacheDir := t.TempDir()
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.CacheDir = cacheDir })
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	for i, file := range []string{"red.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	cached, err := os.ReadDir(cacheDir)
+	is.NoErr(err)
+	is.Equal(2, len(cached))
+
+	// the links are expired and can't be refreshed
+	server.missingFiles = true
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+
+	// evicted after the collage
+	cached, err = os.ReadDir(cacheDir)
+	is.NoErr(err)
+	is.Equal(0, len(cached))
+}
+
+func TestAppSkipFailedDownloads(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.SkipFailedDownloads = true })
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	for i, file := range []string{"red.jpeg", "gone.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	// the missing photo is left out of the collage and kept
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+	is.Equal([]string{"Photos from 2024-08-31 (2)"}, server.sentCaptions)
+	is.Equal("[1,3]", server.deletedMessages)
+
+	_, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal(1, len(toCollage))
+	is.Equal([]int{2}, toCollage[0].messages)
+
+	// nothing is sent nor deleted if every photo fails
+	err = app.cronHandler()
+	is.True(err != nil)
+	is.Equal(1, len(server.sentPhotos))
+	is.Equal("[1,3]", server.deletedMessages)
+
+	history, err := app.db.CollageHistory(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(1, len(history))
+	is.Equal(2, history[0].ImageCount)
+
+	// the kept photo isn't taken for an already collaged one once it's back
+	server.filePaths = map[string]string{"gone.jpeg": "testdir/blue.jpeg"}
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(2, len(server.sentPhotos))
+	is.Equal("Photos from 2024-08-31 (1)", server.sentCaptions[1])
+	is.Equal("[1,3][2]", server.deletedMessages)
+}
+
+func TestAppFallsBackToSmallerPhoto(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:   8,
+		Chat: models.Chat{ID: 1337},
+		Date: int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{
+			{FileID: "small.jpeg", FileSize: 2, Width: 90, Height: 60},
+			{FileID: "big/red.jpeg", FileSize: 30 << 20, Width: 9000, Height: 6000},
+			{FileID: "red.jpeg", FileSize: 10 << 20, Width: 1280, Height: 960},
+		},
+	})
+	is.NoErr(err)
+
+	_, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal([]string{"red.jpeg"}, toCollage[0].fileIDs)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:    9,
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 20, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "big/red.jpeg", FileSize: 30 << 20}},
+	})
+	is.True(err != nil)
+}
+
+func TestAppPicksHighestResolutionOfUnknownSizes(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:   8,
+		Chat: models.Chat{ID: 1337},
+		Date: int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{
+			{FileID: "medium.jpeg", Width: 320, Height: 240},
+			{FileID: "red.jpeg", Width: 1280, Height: 960},
+			{FileID: "small.jpeg", Width: 90, Height: 60},
+		},
+	})
+	is.NoErr(err)
+
+	// equal known sizes are ordered by resolution too, whatever the order of the message
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:   9,
+		Chat: models.Chat{ID: 1337},
+		Date: int(time.Date(2024, time.August, 31, 14, 20, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{
+			{FileID: "green.jpeg", Width: 1280, Height: 960, FileSize: 10},
+			{FileID: "fake.jpeg", Width: 320, Height: 240, FileSize: 10},
+			{FileID: "small.jpeg", Width: 90, Height: 60, FileSize: 10},
+		},
+	})
+	is.NoErr(err)
+
+	_, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal([]string{"red.jpeg", "green.jpeg"}, toCollage[0].fileIDs)
+}
+
+func TestAppStoresPhotoSize(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:   8,
+		Chat: models.Chat{ID: 1337},
+		Date: int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{
+			{FileID: "small.jpeg", Width: 90, Height: 60, FileSize: 1024},
+			{FileID: "red.jpeg", Width: 1280, Height: 960, FileSize: 65536},
+			{FileID: "medium.jpeg", Width: 320, Height: 240, FileSize: 8192},
+		},
+	})
+	is.NoErr(err)
+
+	var width, height, fileSize int
+	err = app.db.db.QueryRowContext(context.TODO(),
+		`select width, height, file_size from links where chat_id = ? and message_id = ?`, 1337, 8,
+	).Scan(&width, &height, &fileSize)
+	is.NoErr(err)
+	is.Equal(1280, width)
+	is.Equal(960, height)
+	is.Equal(65536, fileSize)
+}
+
+func TestAppVideoThumbnails(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:    8,
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Video: &models.Video{FileID: "video.mp4", Thumbnail: &models.PhotoSize{FileID: "red.jpeg", Width: 320, Height: 240}},
+	})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:        9,
+		Chat:      models.Chat{ID: 1337},
+		Date:      int(time.Date(2024, time.August, 31, 14, 20, 0, 0, app.loc).Unix()),
+		Animation: &models.Animation{FileID: "animation.mp4", Thumbnail: &models.PhotoSize{FileID: "green.jpeg", Width: 320, Height: 240}},
+	})
+	is.NoErr(err)
+
+	// a video without a thumbnail is skipped
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:    10,
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 21, 0, 0, app.loc).Unix()),
+		Video: &models.Video{FileID: "video.mp4"},
+	})
+	is.NoErr(err)
+
+	messages, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal([]int{8, 9}, messages)
+	is.Equal([]string{"red.jpeg", "green.jpeg"}, toCollage[0].fileIDs)
+}
+
+func TestAppNestedFilePaths(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	server.filePaths = map[string]string{
+		"red.jpeg":   "photos/file_1/red.jpeg",
+		"green.jpeg": "photos/2024 08/#1?x=%/green.jpeg",
+	}
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	for i, file := range []string{"red.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    8 + i,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, 19+i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, Width: 320, Height: 240}},
+		})
+		is.NoErr(err)
+	}
+
+	_, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal(server.Addr()+"/file/bot1/photos/2024%2008/%231%3Fx=%25/green.jpeg", toCollage[0].links[1])
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(1, len(server.sentPhotos))
+	// photos are downloaded concurrently in any order
+	downloads := slices.Clone(server.downloads)
+	slices.Sort(downloads)
+	is.Equal([]string{"photos/2024 08/#1?x=%/green.jpeg", "photos/file_1/red.jpeg"}, downloads)
+}
+
+func TestAppCollageLogs(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	buf := &bytes.Buffer{}
+	log := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	item := toCollage{date: "2024-08-31"}
+	for _, file := range []string{"red.jpeg", "green.jpeg"} {
+		item.links = append(item.links, app.serverURL+"/file/bot1/testdir/"+file)
+		item.fileIDs = append(item.fileIDs, "")
+	}
+	_, err := app.processCollage(context.TODO(), log, 1337, item, ChatSettings{MaxCols: defaultMaxCols})
+	is.NoErr(err)
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Msg  string
+			Chat int64
+			Date string
+		}
+		is.NoErr(json.Unmarshal([]byte(line), &record))
+		is.Equal(int64(1337), record.Chat)
+		is.Equal("2024-08-31", record.Date)
+		messages = append(messages, record.Msg)
+	}
+	is.Equal([]string{"collage start", "photo downloaded", "photo downloaded", "collage built", "collage sent"}, messages)
+}
+
+func TestAppTargetChat(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+	is.NoErr(app.db.SetSettings(context.TODO(), 1337, ChatSettings{TargetChatID: -100500}))
+
+	for i, file := range []string{"red.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"-100500"}, server.sentChats)
+	// photos are still cleaned up in the source chat
+	is.Equal("[1,2]", server.deletedMessages)
+}
+
+func TestAppUnregistersGoneChat(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	server.chatGone = true
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+		ID:    8,
+	})
+	is.NoErr(err)
+
+	err = app.cronHandler()
+	is.NoErr(err)
+
+	chats, err := app.db.Chats(context.TODO())
+	is.NoErr(err)
+	is.Equal(0, len(chats))
+	pending, err := app.db.PendingCount(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(0, pending)
+}
+
+func TestAppUnregistersChatWhenSendIsForbidden(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	server.forbidSend = true
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+		ID:    8,
+	})
+	is.NoErr(err)
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(0, len(server.sentPhotos))
+	is.Equal("", server.deletedMessages)
+
+	chats, err := app.db.Chats(context.TODO())
+	is.NoErr(err)
+	is.Equal(0, len(chats))
+	pending, err := app.db.PendingCount(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(0, pending)
+}
+
+func TestIsChatGone(t *testing.T) {
+	is := is.New(t)
+
+	is.True(!isChatGone(nil))
+	is.True(isChatGone(fmt.Errorf("%w, Forbidden: bot is not a member of the channel chat", bot.ErrorForbidden)))
+	is.True(isChatGone(errors.Join(errors.New("other"), fmt.Errorf("%w, Bad Request: chat not found", bot.ErrorBadRequest))))
+	is.True(!isChatGone(fmt.Errorf("%w, Bad Request: message can't be deleted", bot.ErrorBadRequest)))
+}
+
+func TestAppMinImages(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.MinImages = 2 })
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	posts := []struct {
+		id   int
+		date time.Time
+		file string
+	}{
+		{1, time.Date(2024, time.August, 31, 14, 0, 0, 0, app.loc), "red.jpeg"},
+		{2, time.Date(2024, time.September, 1, 13, 0, 0, 0, app.loc), "green.jpeg"},
+		{3, time.Date(2024, time.September, 1, 14, 0, 0, 0, app.loc), "blue.jpeg"},
+	}
+	for _, p := range posts {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(p.date.Unix()),
+			Photo: []models.PhotoSize{{FileID: p.file, FileSize: 10}},
+			ID:    p.id,
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-09-01.jpg"}, server.sentPhotos)
+	is.Equal("[2,3]", server.deletedMessages)
+
+	history, err := app.db.CollageHistory(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(1, len(history))
+	is.Equal(2, history[0].ImageCount)
+
+	// the single photo day is left to accumulate
+	messages, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal([]int{1}, messages)
+	is.Equal("2024-08-31", toCollage[0].date)
+
+	server.sentPhotos, server.deletedMessages = nil, ""
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(0, len(server.sentPhotos))
+	is.Equal("", server.deletedMessages)
+}
+
+func TestAppRefreshesExpiredLinks(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.db.RegistreLink(context.TODO(), Link{
+		ChatID:    1337,
+		MessageID: 8,
+		Date:      time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc),
+		URL:       server.Addr() + "/file/bot1/expired/red.jpeg",
+		FileID:    "red.jpeg",
+	})
+	is.NoErr(err)
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+	is.Equal("[8]", server.deletedMessages)
+}
+
+func TestAppGroupMessages(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		MyChatMember: &models.ChatMemberUpdated{Chat: models.Chat{ID: -100, Type: chatTypeSupergroup}},
+	})
+
+	photo := []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}}
+	date := int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix())
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		Message: &models.Message{ID: 8, Chat: models.Chat{ID: -100, Type: chatTypeSupergroup}, Date: date, Photo: photo},
+	})
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		Message: &models.Message{ID: 9, Chat: models.Chat{ID: 42, Type: "private"}, Date: date, Photo: photo},
+	})
+
+	chats, err := app.db.Chats(context.TODO())
+	is.NoErr(err)
+	is.Equal([]int64{-100}, chats)
+
+	messages, _, err := app.db.Links(context.TODO(), -100, app.loc)
+	is.NoErr(err)
+	is.Equal([]int{8}, messages)
+
+	_, _, err = app.db.Links(context.TODO(), 42, app.loc)
+	is.Equal(sql.ErrNoRows, err)
+}
+
+func TestAppMediaGroup(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	date := int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix())
+	for i, file := range []string{"red.jpeg", "green.jpeg", "blue.jpeg"} {
+		group := "album"
+		if i == 2 {
+			group = ""
+		}
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:           i + 1,
+			Chat:         models.Chat{ID: 1337},
+			Date:         date,
+			Photo:        []models.PhotoSize{{FileID: file, FileSize: 10}},
+			MediaGroupID: group,
+		})
+		is.NoErr(err)
+	}
+
+	_, toCollage, err := app.db.Links(context.TODO(), 1337, app.loc)
+	is.NoErr(err)
+	is.Equal([]string{"album", "album", ""}, toCollage[0].mediaGroups)
+}
+
+func TestAppCollageCommand(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.MinImages = 2 })
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:    8,
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+	})
+	is.NoErr(err)
+
+	// nothing posted today
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		ChannelPost: &models.Message{ID: 9, Chat: models.Chat{ID: 1337}, SenderChat: &models.Chat{ID: 1337}, Text: "/collage today"},
+	})
+	is.Equal(0, len(server.sentPhotos))
+
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		ChannelPost: &models.Message{ID: 10, Chat: models.Chat{ID: 1337}, SenderChat: &models.Chat{ID: 1337}, Text: "/collage@collagify_bot"},
+	})
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+	is.Equal("[8]", server.deletedMessages)
+}
+
+func TestAppCollageCommandRefused(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	server.admins = map[string]bool{"7": true}
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: -100}})
+	is.NoErr(err)
+	err = app.botHandleChannelPost(context.TODO(), &models.Message{
+		ID:    8,
+		Chat:  models.Chat{ID: -100},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+	})
+	is.NoErr(err)
+
+	command := func(userID int64, text string) {
+		app.botHandler(context.TODO(), app.bt, &models.Update{
+			Message: &models.Message{ID: 9, Chat: models.Chat{ID: -100, Type: "supergroup"}, From: &models.User{ID: userID}, Text: text},
+		})
+	}
+
+	// regular members can't make collages
+	command(8, "/collage")
+	// unsupported arguments are explained
+	command(7, "/collage yesterday")
+
+	// the chat is being collaged by the cron
+	is.True(app.startCollaging(-100))
+	command(7, "/collage")
+	app.finishCollaging(-100)
+
+	is.Equal(0, len(server.sentPhotos))
+	is.Equal([]sentMessage{
+		{chatID: "-100", text: "Only chat administrators can make collages"},
+		{chatID: "-100", text: "Usage: /collage or /collage today"},
+		{chatID: "-100", text: "Collages of the chat are being made already"},
+	}, server.sentMessages)
+
+	pending, err := app.db.PendingCount(context.TODO(), -100)
+	is.NoErr(err)
+	is.Equal(1, pending)
+
+	// a command running along with the cron doesn't send the collage twice
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		command(7, "/collage")
+	}()
+	is.NoErr(app.cronHandler())
+	wg.Wait()
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+}
+
+func TestAppStatsCommand(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	for i, date := range []time.Time{
+		time.Date(2024, time.September, 1, 10, 0, 0, 0, app.loc),
+		time.Date(2024, time.August, 31, 14, 0, 0, 0, app.loc),
+	} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(date.Unix()),
+			Photo: []models.PhotoSize{{FileID: fmt.Sprintf("%d/red.jpeg", i), FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		ChannelPost: &models.Message{ID: 10, Chat: models.Chat{ID: 1337}, Text: "/stats"},
+	})
+
+	next := app.NextRun().In(app.loc)
+	is.Equal(23, next.Hour())
+	is.Equal(59, next.Minute())
+	is.Equal([]sentMessage{{
+		chatID: "1337",
+		text:   "Pending photos: 2\nOldest photo: 2024-08-31\nNext collage: " + next.Format("2006-01-02 15:04 MST"),
+	}}, server.sentMessages)
+}
+
+func TestAppColsCommand(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+	is.NoErr(app.db.SetSettings(context.TODO(), 1337, ChatSettings{MinImages: 3}))
+
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		ChannelPost: &models.Message{ID: 10, Chat: models.Chat{ID: 1337}, SenderChat: &models.Chat{ID: 1337}, Text: "/cols 4"},
+	})
+
+	settings, err := app.db.GetSettings(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(ChatSettings{MaxCols: 4, MinImages: 3}, settings)
+	is.Equal([]sentMessage{{chatID: "1337", text: "Collages will have up to 4 columns"}}, server.sentMessages)
+
+	// out of range values are refused
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		ChannelPost: &models.Message{ID: 11, Chat: models.Chat{ID: 1337}, SenderChat: &models.Chat{ID: 1337}, Text: "/cols 11"},
+	})
+
+	settings, err = app.db.GetSettings(context.TODO(), 1337)
+	is.NoErr(err)
+	is.Equal(4, settings.MaxCols)
+	is.Equal(2, len(server.sentMessages))
+	is.Equal("Usage: /cols N, where N is from 1 to 10", server.sentMessages[1].text)
+}
+
+func TestAppColsCommandAdminsOnly(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	server.admins = map[string]bool{"7": true}
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: -100}})
+	is.NoErr(err)
+
+	// regular members can't change settings
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		Message: &models.Message{ID: 10, Chat: models.Chat{ID: -100, Type: "supergroup"}, From: &models.User{ID: 8}, Text: "/cols 4"},
+	})
+
+	settings, err := app.db.GetSettings(context.TODO(), -100)
+	is.NoErr(err)
+	is.Equal(0, settings.MaxCols)
+	is.Equal([]sentMessage{{chatID: "-100", text: "Only chat administrators can change the settings"}}, server.sentMessages)
+
+	// neither can other chats sending on their behalf
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		Message: &models.Message{ID: 11, Chat: models.Chat{ID: -100, Type: "supergroup"}, SenderChat: &models.Chat{ID: 42}, Text: "/cols 4"},
+	})
+
+	settings, err = app.db.GetSettings(context.TODO(), -100)
+	is.NoErr(err)
+	is.Equal(0, settings.MaxCols)
+
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		Message: &models.Message{ID: 12, Chat: models.Chat{ID: -100, Type: "supergroup"}, From: &models.User{ID: 7}, Text: "/cols 4"},
+	})
+
+	settings, err = app.db.GetSettings(context.TODO(), -100)
+	is.NoErr(err)
+	is.Equal(4, settings.MaxCols)
+	is.Equal(3, len(server.sentMessages))
+	is.Equal("Collages will have up to 4 columns", server.sentMessages[2].text)
+}
+
+func TestAppHelpCommand(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.Cron = "0 21 * * *" })
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+
+	app.botHandler(context.TODO(), app.bt, &models.Update{
+		ChannelPost: &models.Message{ID: 10, Chat: models.Chat{ID: 1337}, Text: "/help"},
+	})
+
+	is.Equal(1, len(server.sentMessages))
+	is.Equal("1337", server.sentMessages[0].chatID)
+	help := server.sentMessages[0].text
+	for _, want := range []string{`"0 21 * * *"`, app.loc.String(), " 21:00 ", "/collage", "/stats", "/cols N", "from 1 to 10", "/help"} {
+		is.True(strings.Contains(help, want)) // help mentions the schedule, zone and commands
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	is := is.New(t)
+
+	tests := []struct {
+		text, cmd, args string
+	}{
+		{"/collage", "collage", ""},
+		{"/collage today", "collage", "today"},
+		{"/Collage@collagify_bot  today ", "collage", "today"},
+		{"/cols 4", "cols", "4"},
+	}
+	for _, tt := range tests {
+		cmd, args := parseCommand(tt.text)
+		is.Equal(tt.cmd, cmd)
+		is.Equal(tt.args, args)
+	}
+}
+
+func TestAppCron(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is, func(args *AppArgs) { args.Cron = "CRON_TZ=UTC 0 * * * *" })
+
+	entries := app.crn.Entries()
+	is.Equal(2, len(entries)) // collages and storage maintenance
+	next := entries[0].Schedule.Next(time.Date(2024, time.August, 31, 14, 19, 0, 0, time.UTC))
+	is.Equal(time.Date(2024, time.August, 31, 15, 0, 0, 0, time.UTC), next)
+
+	_, err := New(app.log, AppArgs{Cron: "every minute", DBPath: ":memory:"})
+	is.True(err != nil)
+
+	t.Setenv("COLLAGIFY_TG_TOKEN", "1")
+	t.Setenv("COLLAGIFY_CRON", "61 * * * *")
+	_, err = NewAppArgs()
+	is.True(err != nil)
+
+	t.Setenv("COLLAGIFY_CRON", "@hourly")
+	args, err := NewAppArgs()
+	is.NoErr(err)
+	is.Equal("@hourly", args.Cron)
+}
+
+func TestNewAppArgsTokenFile(t *testing.T) {
+	is := is.New(t)
+
+	file := path.Join(t.TempDir(), "token")
+	is.NoErr(os.WriteFile(file, []byte("file-token\n"), 0o600))
+
+	t.Setenv("COLLAGIFY_TG_TOKEN", "env-token")
+	t.Setenv("COLLAGIFY_TG_TOKEN_FILE", file)
+	args, err := NewAppArgs()
 	is.NoErr(err)
-	moscowLoc = loc
+	is.Equal("file-token", args.Token)
 
-	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+	t.Setenv("COLLAGIFY_TG_TOKEN_FILE", path.Join(t.TempDir(), "missing"))
+	_, err = NewAppArgs()
+	is.True(err != nil)
+}
+
+func TestAppBadDBPath(t *testing.T) {
+	is := is.New(t)
 
 	server := StartServer(is)
 	t.Cleanup(server.close)
 
-	app, err := New(log, AppArgs{Server: server.Addr(), DBPath: path.Join(t.TempDir(), "collagify.sqlite"), Token: "1"})
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	_, err := New(log, AppArgs{Server: server.Addr(), Token: "1", DBPath: path.Join(t.TempDir(), "missing", "db.sqlite")})
+	is.True(err != nil)
+}
+
+func TestAppTimezone(t *testing.T) {
+	is := is.New(t)
+
+	loc, err := time.LoadLocation("America/New_York")
 	is.NoErr(err)
-	t.Cleanup(app.Close)
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.Location = loc })
 
 	err = app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
 	is.NoErr(err)
 
-	err = app.botHandleChannelPost(context.TODO(), &models.Message{
-		Chat: models.Chat{ID: 1337},
-		Date: int(time.Date(2024, time.August, 31, 14, 19, 0, 0, loc).Unix()),
-		Photo: []models.PhotoSize{
-			{FileID: "red.jpeg", FileSize: 10},
-			{FileID: "fake.jpeg", FileSize: 2},
-		},
-		ID: 8,
-	})
+	// the same New York day, but different days in Moscow
+	for i, date := range []time.Time{
+		time.Date(2024, time.August, 31, 15, 0, 0, 0, loc),
+		time.Date(2024, time.August, 31, 18, 0, 0, 0, loc),
+	} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(date.Unix()),
+			Photo: []models.PhotoSize{{FileID: fmt.Sprintf("%d/red.jpeg", i), FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+	is.Equal("[1,2]", server.deletedMessages)
+
+	t.Setenv("COLLAGIFY_TG_TOKEN", "1")
+	t.Setenv("COLLAGIFY_TZ", "Asia/Tokyo")
+	args, err := NewAppArgs()
+	is.NoErr(err)
+	is.Equal("Asia/Tokyo", args.Location.String())
+
+	t.Setenv("COLLAGIFY_TZ", "Mars/Olympus")
+	_, err = NewAppArgs()
+	is.True(err != nil)
+}
+
+func TestAppChatSettings(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	for _, chatID := range []int64{1337, 42} {
+		err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: chatID}})
+		is.NoErr(err)
+		for i, file := range []string{"red.jpeg", "green.jpeg", "blue.jpeg"} {
+			err = app.botHandleChannelPost(context.TODO(), &models.Message{
+				ID:    int(chatID) + i,
+				Chat:  models.Chat{ID: chatID},
+				Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+				Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+			})
+			is.NoErr(err)
+		}
+	}
+
+	is.NoErr(app.db.SetSettings(context.TODO(), 1337, ChatSettings{MaxCols: 1}))
+	is.NoErr(app.db.SetSettings(context.TODO(), 42, ChatSettings{Disabled: true}))
+
+	err := app.cronHandler()
+	is.NoErr(err)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+
+	// a single column of three photos
+	f, err := os.Open("testdata/red.jpeg")
+	is.NoErr(err)
+	defer f.Close()
+	cell, _, err := stdimage.DecodeConfig(f)
+	is.NoErr(err)
+	is.Equal(stdimage.Pt(cell.Width, 3*cell.Height), server.sentSizes[0])
+
+	pending, err := app.db.PendingCount(context.TODO(), 42)
+	is.NoErr(err)
+	is.Equal(3, pending)
+}
+
+func TestAppMaxCols(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("COLLAGIFY_TG_TOKEN", "1")
+	t.Setenv("COLLAGIFY_MAX_COLS", "0")
+	_, err := NewAppArgs()
+	is.True(err != nil)
+
+	t.Setenv("COLLAGIFY_MAX_COLS", "3")
+	args, err := NewAppArgs()
+	is.NoErr(err)
+	is.Equal(3, args.MaxCols)
+
+	app, server := newTestApp(t, is, func(a *AppArgs) { a.MaxCols = args.MaxCols })
+
+	err = app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+	for i := range 6 {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: fmt.Sprintf("%d/red.jpeg", i), FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+
+	// three columns of two photos
+	f, err := os.Open("testdata/red.jpeg")
+	is.NoErr(err)
+	defer f.Close()
+	cell, _, err := stdimage.DecodeConfig(f)
+	is.NoErr(err)
+	is.Equal(stdimage.Pt(3*cell.Width, 2*cell.Height), server.sentSizes[0])
+}
+
+func TestAppDownloadTimeout(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is, func(args *AppArgs) { args.DownloadTimeout = 50 * time.Millisecond })
+	app.downloadBackoff = time.Millisecond
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(slow.Close)
+
+	start := time.Now()
+	_, err := app.processCollage(context.TODO(), app.log, 1337, toCollage{
+		date:    "2024-08-31",
+		links:   []string{slow.URL + "/red.jpeg"},
+		fileIDs: []string{""},
+	}, ChatSettings{MaxCols: defaultMaxCols})
+	is.True(err != nil)
+	is.True(time.Since(start) < time.Second)
+}
+
+func TestAppDownload(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	body, err := app.download(context.TODO(), server.Addr()+"/file/bot1/testdir/red.jpeg")
+	is.NoErr(err)
+	want, err := os.ReadFile("testdata/red.jpeg")
+	is.NoErr(err)
+	is.Equal(want, body)
+
+	_, err = app.download(context.TODO(), server.Addr()+"/missing")
+	is.True(err != nil)
+}
+
+func TestAppDownloadAll(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is, func(args *AppArgs) { args.DownloadConcurrency = 4 })
+
+	const delay = 100 * time.Millisecond
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	t.Cleanup(slow.Close)
+
+	item := toCollage{date: "2024-08-31"}
+	for _, p := range []string{"/1", "/2", "/missing", "/4"} {
+		item.links = append(item.links, slow.URL+p)
+		item.fileIDs = append(item.fileIDs, "")
+	}
+
+	start := time.Now()
+	_, _, err := app.downloadAll(context.TODO(), app.log, item)
+	is.True(err != nil) // fails on the missing photo by default
+	is.True(time.Since(start) < 4*delay)
+
+	app.skipFailedDownloads = true
+	images, downloaded, err := app.downloadAll(context.TODO(), app.log, item)
+	is.NoErr(err)
+	is.Equal([][]byte{[]byte("/1"), []byte("/2"), []byte("/4")}, images)
+	is.Equal([]int{0, 1, 3}, downloaded)
+}
+
+func TestAppDownloadRetry(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+	app.downloadBackoff = time.Millisecond
+
+	var requests atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if n <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("photo"))
+	}))
+	t.Cleanup(flaky.Close)
+
+	body, err := app.downloadRetry(context.TODO(), flaky.URL)
+	is.NoErr(err)
+	is.Equal([]byte("photo"), body)
+	is.Equal(int32(3), requests.Load())
+
+	// gives up after the last attempt
+	requests.Store(-10)
+	_, err = app.downloadRetry(context.TODO(), flaky.URL)
+	is.True(err != nil)
+	is.Equal(int32(-7), requests.Load())
+
+	// a missing photo is not retried
+	requests.Store(0)
+	_, err = app.downloadRetry(context.TODO(), flaky.URL+"/missing")
+	is.True(err != nil)
+	is.Equal(int32(1), requests.Load())
+
+	// a done context stops retries
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	requests.Store(-10)
+	_, err = app.downloadRetry(ctx, flaky.URL)
+	is.True(errors.Is(err, context.Canceled))
+}
+
+func TestAppDeleteMessagesBatches(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	messages := make([]int, 250)
+	for i := range messages {
+		messages[i] = i + 1
+	}
+
+	err := app.deleteMessages(context.TODO(), 1337, messages)
+	is.NoErr(err)
+	is.Equal(3, server.deleteCalls)
+
+	var deleted []int
+	for _, batch := range strings.SplitAfter(server.deletedMessages, "]") {
+		if batch == "" {
+			continue
+		}
+		var ids []int
+		is.NoErr(json.Unmarshal([]byte(batch), &ids))
+		is.True(len(ids) <= 100)
+		deleted = append(deleted, ids...)
+	}
+	is.Equal(messages, deleted)
+}
+
+func TestAppNotifiesAdmin(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is, func(args *AppArgs) { args.AdminChatID = -42 })
+	server.failDelete = true
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
 	is.NoErr(err)
 
+	// nothing to collage is not an error
+	err = app.cronHandler()
+	is.NoErr(err)
+	is.Equal(0, len(server.sentMessages))
+
 	err = app.botHandleChannelPost(context.TODO(), &models.Message{
-		Chat: models.Chat{ID: 1337},
-		Date: int(time.Date(2024, time.September, 1, 13, 11, 0, 0, loc).Unix()),
-		Photo: []models.PhotoSize{
-			{FileID: "green.jpeg", FileSize: 10},
-			{FileID: "fake.jpeg", FileSize: 2},
-		},
-		ID: 9,
+		Chat:  models.Chat{ID: 1337},
+		Date:  int(time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc).Unix()),
+		Photo: []models.PhotoSize{{FileID: "red.jpeg", FileSize: 10}},
+		ID:    8,
 	})
 	is.NoErr(err)
 
+	err = app.cronHandler()
+	is.True(err != nil)
+	is.Equal(1, len(server.sentMessages))
+	is.Equal("-42", server.sentMessages[0].chatID)
+	is.True(strings.HasPrefix(server.sentMessages[0].text, "Collages failed with 1 error(s):\n- delete messages from channel 1337"))
+}
+
+func TestAppAdminSummary(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is, func(args *AppArgs) {
+		args.AdminChatID = -42
+		args.AdminSummary = true
+	})
+
+	for i, chatID := range []int64{1337, 42, 43} {
+		err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: chatID}})
+		is.NoErr(err)
+		for j, file := range []string{"red.jpeg", "green.jpeg"}[:2-i%2] {
+			err = app.botHandleChannelPost(context.TODO(), &models.Message{
+				ID:    10*i + j,
+				Chat:  models.Chat{ID: chatID},
+				Date:  int(time.Date(2024, time.August, 31, 14, j, 0, 0, app.loc).Unix()),
+				Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+			})
+			is.NoErr(err)
+		}
+	}
+	is.NoErr(app.db.SetSettings(context.TODO(), 43, ChatSettings{TZ: "Mars/Olympus"}))
+
+	err := app.cronHandler()
+	is.True(err != nil)
+
+	// the errors are followed by the summary
+	is.Equal(2, len(server.sentMessages))
+	is.Equal("-42", server.sentMessages[1].chatID)
+	is.Equal("Collages run finished:\nChats: 3\nCollages sent: 2\nImages downloaded: 3\nErrors: 1", server.sentMessages[1].text)
+
+	// runs without errors are summarized too
+	is.NoErr(app.db.SetSettings(context.TODO(), 43, ChatSettings{}))
 	err = app.cronHandler()
 	is.NoErr(err)
-	is.Equal([]string{"collage_2024-08-31.jpg", "collage_2024-09-01.jpg"}, server.sentPhotos)
-	is.Equal("[8,9]", server.deletedMessages)
+	is.Equal(3, len(server.sentMessages))
+	is.Equal("Collages run finished:\nChats: 1\nCollages sent: 1\nImages downloaded: 2\nErrors: 0", server.sentMessages[2].text)
+}
 
-	messages, toCollage, err := app.db.Links(context.TODO(), 1337)
-	is.Equal(0, len(messages))
-	is.Equal(0, len(toCollage))
-	is.Equal(sql.ErrNoRows, err)
+func TestErrorsSummary(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal("Collages failed with 1 error(s):\n- boom", errorsSummary(errors.New("boom")))
+
+	var err error
+	for i := range maxSummaryErrors + 2 {
+		err = errors.Join(err, fmt.Errorf("error %d", i))
+	}
+	summary := errorsSummary(err)
+	is.True(strings.HasPrefix(summary, "Collages failed with 12 error(s):\n- error 0\n- error 1\n"))
+	is.True(strings.HasSuffix(summary, "- error 9\n... and 2 more"))
+
+	summary = errorsSummary(errors.New(strings.Repeat("x", 1000)))
+	is.Equal(len("Collages failed with 1 error(s):\n- ")+maxSummaryErrorLen+len("…"), len(summary))
+}
+
+func TestAppSendRetry(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	app.sendBackoff = time.Millisecond
+	server.failedSends = 1
+
+	collage, err := os.ReadFile("testdata/red.jpeg")
+	is.NoErr(err)
+
+	err = app.sendCollage(context.TODO(), 1337, "collage_2024-08-31.jpg", "", collage, false)
+	is.NoErr(err)
+	is.Equal(0, server.failedSends)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+
+	// gives up after the last attempt
+	server.failedSends = sendAttempts
+	err = app.sendCollage(context.TODO(), 1337, "collage_2024-08-31.jpg", "", collage, false)
+	is.True(err != nil)
+	is.Equal(0, server.failedSends)
+
+	// a bad request is not retried
+	calls := 0
+	err = app.retrySend(context.TODO(), func() error {
+		calls++
+		return fmt.Errorf("%w, wrong file", bot.ErrorBadRequest)
+	})
+	is.True(errors.Is(err, bot.ErrorBadRequest))
+	is.Equal(1, calls)
+}
+
+func TestAppRateLimit(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	app.retryAfterUnit = time.Millisecond
+	server.rateLimited = 1
+
+	collage, err := os.ReadFile("testdata/red.jpeg")
+	is.NoErr(err)
+
+	err = app.sendCollage(context.TODO(), 1337, "collage_2024-08-31.jpg", "", collage, false)
+	is.NoErr(err)
+	is.Equal(0, server.rateLimited)
+	is.Equal([]string{"collage_2024-08-31.jpg"}, server.sentPhotos)
+
+	// gives up after the last attempt
+	server.rateLimited = rateLimitAttempts
+	err = app.sendCollage(context.TODO(), 1337, "collage_2024-08-31.jpg", "", collage, false)
+	is.True(err != nil)
+	is.Equal(0, server.rateLimited)
+
+	// a done context stops retries
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	err = app.retryRateLimited(ctx, func() error {
+		return &bot.TooManyRequestsError{RetryAfter: 1}
+	})
+	is.True(errors.Is(err, context.Canceled))
+}
+
+func TestAppCancelDownloads(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(slow.Close)
+
+	item := toCollage{date: "2024-08-31"}
+	for i := range 10 {
+		item.links = append(item.links, fmt.Sprintf("%s/%d.jpeg", slow.URL, i))
+		item.fileIDs = append(item.fileIDs, "")
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := app.processCollage(ctx, app.log, 1337, item, ChatSettings{MaxCols: defaultMaxCols})
+	is.True(errors.Is(err, context.Canceled))
+	is.True(time.Since(start) < time.Second)
+	is.Equal(0, len(server.sentPhotos))
+}
+
+func TestAppCloseWaitsForCollage(t *testing.T) {
+	is := is.New(t)
+
+	collage, err := os.ReadFile("testdata/red.jpeg")
+	is.NoErr(err)
+
+	for _, tt := range []struct {
+		name    string
+		timeout time.Duration
+		sent    int
+	}{
+		{"finished", time.Minute, 1},
+		{"cancelled on timeout", 50 * time.Millisecond, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			app, server := newTestApp(t, is)
+			app.shutdownTimeout = tt.timeout
+
+			started := make(chan struct{}, 2)
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				select {
+				case <-r.Context().Done():
+				case <-time.After(300 * time.Millisecond):
+					w.Write(collage)
+				}
+			}))
+			t.Cleanup(slow.Close)
+
+			day := time.Date(2024, time.August, 31, 14, 19, 0, 0, app.loc)
+			is.NoErr(app.db.RegisterChat(context.TODO(), 1337, day))
+			is.NoErr(app.db.RegisterLinks(context.TODO(), []Link{
+				{ChatID: 1337, MessageID: 1, Date: day, URL: slow.URL + "/1.jpeg"},
+				{ChatID: 1337, MessageID: 2, Date: day, URL: slow.URL + "/2.jpeg"},
+			}))
+
+			go app.cronHandler()
+			<-started
+
+			start := time.Now()
+			app.Close()
+			is.Equal(tt.sent, len(server.sentPhotos))
+			if tt.sent == 0 {
+				is.True(time.Since(start) < 300*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestAppCloseRefusesNewJobs(t *testing.T) {
+	is := is.New(t)
+
+	app, server := newTestApp(t, is)
+	is.True(app.startJob())
+
+	closed := make(chan struct{})
+	go func() {
+		app.Close()
+		close(closed)
+	}()
+
+	// jobs started before closing are waited for
+	select {
+	case <-closed:
+		is.Fail() // closed with a running job
+	case <-time.After(50 * time.Millisecond):
+	}
+	is.True(!app.startJob())
+	app.jobs.Done()
+	<-closed
+
+	// the storage is closed, so the collages must not start at all
+	is.NoErr(app.cronHandler())
+	is.Equal(0, len(server.sentPhotos))
+}
+
+func newTestApp(t *testing.T, is *is.I, opts ...func(*AppArgs)) (*App, *server) {
+	t.Helper()
+
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	server := StartServer(is)
+	t.Cleanup(server.close)
+
+	args := AppArgs{Server: server.Addr(), DBPath: ":memory:", Token: "1", MinImages: 1}
+	for _, opt := range opts {
+		opt(&args)
+	}
+
+	app, err := New(log, args)
+	is.NoErr(err)
+	t.Cleanup(app.Close)
+
+	return app, server
 }
 
 type server struct {
-	is              *is.I
-	http            *httptest.Server
+	is   *is.I
+	http *httptest.Server
+	// mu serializes requests as chats are collaged concurrently
+	mu              sync.Mutex
 	sentPhotos      []string
+	sentChats       []string
+	sentSizes       []stdimage.Point
+	sentAlbums      [][]string
+	sentCaptions    []string
 	deletedMessages string
+	failDelete      bool
+	chatGone        bool
+	// forbidSend makes sending photos fail as if the bot was removed from the chat
+	forbidSend bool
+	// missingFiles makes files not found
+	missingFiles bool
+	deleteCalls  int
+	sentMessages []sentMessage
+	// rateLimited is the number of photos to reject with Too Many Requests
+	rateLimited int
+	// failedSends is the number of photos to reject with Internal Server Error
+	failedSends int
+	// silentSends are disable_notification values of sent photos and albums
+	silentSends []string
+	// sentFormats are image formats of sent photos
+	sentFormats []string
+	// filePaths overrides paths of files by their ids
+	filePaths map[string]string
+	// downloads are paths of downloaded files
+	downloads []string
+	// onDelete is called while messages are deleted
+	onDelete func()
+	// admins are ids of users that administer chats
+	admins map[string]bool
+}
+
+type sentMessage struct {
+	chatID string
+	text   string
 }
 
 func StartServer(is *is.I) *server {
@@ -100,10 +1966,17 @@ func (s *server) handler() http.Handler {
 	mux.HandleFunc("POST /bot1/getMe", s.getMe)
 	mux.HandleFunc("POST /bot1/getFile", s.getFile)
 	mux.HandleFunc("POST /bot1/sendPhoto", s.sendPhoto)
-	mux.HandleFunc("GET /file/bot1/testdir/{file}", s.downloadFile)
+	mux.HandleFunc("POST /bot1/sendMediaGroup", s.sendMediaGroup)
+	mux.HandleFunc("POST /bot1/sendMessage", s.sendMessage)
+	mux.HandleFunc("GET /file/bot1/{file...}", s.downloadFile)
 	mux.HandleFunc("POST /bot1/deleteMessages", s.deleteMessages)
+	mux.HandleFunc("POST /bot1/getChatMember", s.getChatMember)
 
-	return mux
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	})
 }
 
 func (s *server) getMe(w http.ResponseWriter, r *http.Request) {
@@ -115,8 +1988,17 @@ func (s *server) getFile(w http.ResponseWriter, r *http.Request) {
 	s.is.NoErr(err)
 
 	fileID := r.PostForm.Get("file_id")
+	if strings.HasPrefix(fileID, "big/") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: file is too big"}`))
+		return
+	}
 
-	data, err := json.Marshal(models.File{FileID: fileID, FilePath: "testdir/" + fileID})
+	filePath := "testdir/" + fileID
+	if p, ok := s.filePaths[fileID]; ok {
+		filePath = p
+	}
+	data, err := json.Marshal(models.File{FileID: fileID, FilePath: filePath})
 	s.is.NoErr(err)
 
 	w.WriteHeader(http.StatusOK)
@@ -131,32 +2013,139 @@ func (s *server) getFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) sendPhoto(w http.ResponseWriter, r *http.Request) {
-	filename, err := s.extract(r, "filename")
-	s.is.NoErr(err)
-	s.sentPhotos = append(s.sentPhotos, filename)
+	if s.forbidSend {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot is not a member of the channel chat"}`))
+		return
+	}
+	if s.rateLimited > 0 {
+		s.rateLimited--
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`))
+		return
+	}
+	if s.failedSends > 0 {
+		s.failedSends--
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"ok":false,"error_code":500,"description":"Internal Server Error"}`))
+		return
+	}
+
+	s.is.NoErr(r.ParseMultipartForm(32 << 20))
+	for _, files := range r.MultipartForm.File {
+		for _, fh := range files {
+			f, err := fh.Open()
+			s.is.NoErr(err)
+			cfg, format, err := stdimage.DecodeConfig(f)
+			f.Close()
+			s.is.NoErr(err)
+
+			s.sentPhotos = append(s.sentPhotos, fh.Filename)
+			s.sentChats = append(s.sentChats, r.FormValue("chat_id"))
+			s.sentSizes = append(s.sentSizes, stdimage.Pt(cfg.Width, cfg.Height))
+			s.sentFormats = append(s.sentFormats, format)
+		}
+	}
+	if caption := r.FormValue("caption"); caption != "" {
+		s.sentCaptions = append(s.sentCaptions, caption)
+	}
+	s.silentSends = append(s.silentSends, r.FormValue("disable_notification"))
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"ok":true,"result":{}}`))
 }
 
 func (s *server) downloadFile(w http.ResponseWriter, r *http.Request) {
-	file := r.PathValue("file")
+	if s.missingFiles {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.downloads = append(s.downloads, r.PathValue("file"))
+
+	// file may be prefixed with a directory to get distinct links for the same image
+	file := path.Base(r.PathValue("file"))
 	data, err := os.ReadFile("testdata/" + file)
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	s.is.NoErr(err)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
+func (s *server) sendMediaGroup(w http.ResponseWriter, r *http.Request) {
+	s.is.NoErr(r.ParseMultipartForm(32 << 20))
+
+	var media []struct {
+		Media   string `json:"media"`
+		Caption string `json:"caption"`
+	}
+	s.is.NoErr(json.Unmarshal([]byte(r.FormValue("media")), &media))
+
+	var album []string
+	for _, m := range media {
+		filename := strings.TrimPrefix(m.Media, "attach://")
+		s.is.Equal(1, len(r.MultipartForm.File[filename]))
+		album = append(album, filename)
+		if m.Caption != "" {
+			s.sentCaptions = append(s.sentCaptions, m.Caption)
+		}
+	}
+	s.sentAlbums = append(s.sentAlbums, album)
+	s.silentSends = append(s.silentSends, r.FormValue("disable_notification"))
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"ok":true,"result":[]}`))
+}
+
+func (s *server) sendMessage(w http.ResponseWriter, r *http.Request) {
+	s.is.NoErr(r.ParseMultipartForm(32 << 20))
+	s.sentMessages = append(s.sentMessages, sentMessage{chatID: r.FormValue("chat_id"), text: r.FormValue("text")})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"ok":true,"result":{}}`))
+}
+
 func (s *server) deleteMessages(w http.ResponseWriter, r *http.Request) {
+	if s.failDelete {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: message can't be deleted"}`))
+		return
+	}
+	if s.chatGone {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+		return
+	}
+
+	if s.onDelete != nil {
+		s.onDelete()
+	}
+
 	ids, err := s.extract(r, "message_ids")
 	s.is.NoErr(err)
 	s.deletedMessages += ids
+	s.deleteCalls++
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"ok":true,"result":true}`))
 }
 
+func (s *server) getChatMember(w http.ResponseWriter, r *http.Request) {
+	s.is.NoErr(r.ParseMultipartForm(1024))
+
+	status := "member"
+	if s.admins[r.FormValue("user_id")] {
+		status = "administrator"
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"ok":true,"result":{"status":%q,"user":{"id":%s}}}`, status, r.FormValue("user_id"))
+}
+
 func (s *server) extract(r *http.Request, field string) (string, error) {
 	contentType := r.Header.Get("Content-Type")
 	mediaType, params, err := mime.ParseMediaType(contentType)
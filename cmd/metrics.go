@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are exposed in the Prometheus text format.
+type metrics struct {
+	collagesSent     counter
+	imagesDownloaded counter
+	downloadErrors   counter
+	cronRuns         counter
+	cronErrors       counter
+	buildDuration    *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		buildDuration: newHistogram([]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}),
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	m.collagesSent.write(w, "collagify_collages_sent_total", "Collages sent to chats.")
+	m.imagesDownloaded.write(w, "collagify_images_downloaded_total", "Photos downloaded for collages.")
+	m.downloadErrors.write(w, "collagify_download_errors_total", "Photos failed to download.")
+	m.cronRuns.write(w, "collagify_cron_runs_total", "Runs of the cron handler.")
+	m.cronErrors.write(w, "collagify_cron_errors_total", "Runs of the cron handler finished with an error.")
+	m.buildDuration.write(w, "collagify_collage_build_duration_seconds", "Time to build a collage.")
+}
+
+type counter struct {
+	v atomic.Int64
+}
+
+func (c *counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *counter) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, c.v.Load())
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	// counts of observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/matryer/is"
+)
+
+func TestMetrics(t *testing.T) {
+	is := is.New(t)
+
+	app, _ := newTestApp(t, is)
+
+	metrics := httptest.NewServer(app.metrics)
+	t.Cleanup(metrics.Close)
+
+	scrape := func() string {
+		resp, err := http.Get(metrics.URL + "/metrics")
+		is.NoErr(err)
+		defer resp.Body.Close()
+		is.Equal(http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		is.NoErr(err)
+		return string(body)
+	}
+
+	body := scrape()
+	is.True(strings.Contains(body, "collagify_collages_sent_total 0\n"))
+
+	err := app.botHandleMyChatMember(context.TODO(), &models.ChatMemberUpdated{Chat: models.Chat{ID: 1337}})
+	is.NoErr(err)
+	for i, file := range []string{"red.jpeg", "green.jpeg"} {
+		err = app.botHandleChannelPost(context.TODO(), &models.Message{
+			ID:    i + 1,
+			Chat:  models.Chat{ID: 1337},
+			Date:  int(time.Date(2024, time.August, 31, 14, i, 0, 0, app.loc).Unix()),
+			Photo: []models.PhotoSize{{FileID: file, FileSize: 10}},
+		})
+		is.NoErr(err)
+	}
+
+	err = app.cronHandler()
+	is.NoErr(err)
+
+	body = scrape()
+	is.True(strings.Contains(body, "collagify_collages_sent_total 1\n"))
+	is.True(strings.Contains(body, "collagify_images_downloaded_total 2\n"))
+	is.True(strings.Contains(body, "collagify_download_errors_total 0\n"))
+	is.True(strings.Contains(body, "collagify_cron_runs_total 1\n"))
+	is.True(strings.Contains(body, "collagify_collage_build_duration_seconds_count 1\n"))
+	is.True(strings.Contains(body, `collagify_collage_build_duration_seconds_bucket{le="+Inf"} 1`))
+}
+
+func TestHistogram(t *testing.T) {
+	is := is.New(t)
+
+	h := newHistogram([]float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(3)
+	h.Observe(10)
+
+	b := &strings.Builder{}
+	h.write(b, "test", "Test histogram.")
+	is.Equal(`# HELP test Test histogram.
+# TYPE test histogram
+test_bucket{le="1"} 1
+test_bucket{le="5"} 2
+test_bucket{le="+Inf"} 3
+test_sum 13.5
+test_count 3
+`, b.String())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const migrationsTable = `
+	create table if not exists schema_migrations (
+		version integer not null primary key,
+		timestamp integer not null
+	);
+`
+
+type migration struct {
+	name string
+	up   func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations are applied in order, the version of a migration is its index + 1.
+// Never reorder or change applied migrations, add a new one instead.
+var migrations = []migration{
+	{name: "create chats and links tables", up: execStatements(chatsTable, linksTable)},
+	{name: "create links chat and timestamp index", up: execStatements(linksIndex)},
+	{name: "add links caption", up: execStatements(linksCaption)},
+	{name: "add links file id", up: execStatements(linksFileID)},
+	{name: "add links media group id", up: execStatements(linksMediaGroup)},
+	{name: "create chat settings table", up: execStatements(chatSettingsTable)},
+	{name: "create collages table", up: execStatements(collagesTable, collagesIndex)},
+	{name: "add chat settings target chat id", up: execStatements(chatSettingsTarget)},
+	{name: "add collages last link", up: execStatements(collagesLastLink)},
+	{name: "add message id to links chat and timestamp index", up: execStatements(linksMessageIndex)},
+	{name: "add chat settings delete originals and links done", up: execStatements(chatSettingsDeleteOriginals, linksDone)},
+	{name: "add chat settings silent", up: execStatements(chatSettingsSilent)},
+	{name: "add links photo size", up: execStatements(linksPhotoSize)},
+	{name: "add chat settings output format", up: execStatements(chatSettingsOutputFormat)},
+}
+
+func execStatements(statements ...string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrate brings the schema to the latest version applying every migration
+// that was not applied yet, each in its own transaction.
+func migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, migrationsTable); err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+
+	var version int
+	err := db.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_migrations`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err := applyMigration(ctx, db, i+1, migrations[i])
+		if err != nil {
+			return fmt.Errorf("apply migration %d %q: %w", i+1, migrations[i].name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, version int, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(ctx, tx); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, timestamp) values (?, ?)`, version, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestMigrateOldDatabase(t *testing.T) {
+	is := is.New(t)
+
+	dbPath := path.Join(t.TempDir(), "collagify.sqlite")
+
+	// database created before migrations were introduced
+	db, err := sql.Open("sqlite3", dbPath)
+	is.NoErr(err)
+	_, err = db.Exec(chatsTable)
+	is.NoErr(err)
+	_, err = db.Exec(linksTable)
+	is.NoErr(err)
+	_, err = db.Exec(`insert into chats (chat_id, timestamp) values (1337, 1)`)
+	is.NoErr(err)
+	_, err = db.Exec(`insert into links (chat_id, timestamp, url, message_id) values (1337, 1, 'http://link', 8)`)
+	is.NoErr(err)
+	is.NoErr(db.Close())
+
+	s, err := NewStorage(dbPath)
+	is.NoErr(err)
+	t.Cleanup(func() { s.Close() })
+
+	is.Equal(len(migrations), schemaVersion(is, s.db))
+
+	chats, err := s.Chats(context.TODO())
+	is.NoErr(err)
+	is.Equal([]int64{1337}, chats)
+
+	messages, _, err := s.Links(context.TODO(), 1337, time.Local)
+	is.NoErr(err)
+	is.Equal([]int{8}, messages)
+
+	// reopening doesn't apply anything twice
+	is.NoErr(s.Close())
+	s, err = NewStorage(dbPath)
+	is.NoErr(err)
+	is.Equal(len(migrations), schemaVersion(is, s.db))
+
+	var applied int
+	is.NoErr(s.db.QueryRow(`select count(*) from schema_migrations`).Scan(&applied))
+	is.Equal(len(migrations), applied)
+}
+
+func schemaVersion(is *is.I, db *sql.DB) int {
+	var version int
+	err := db.QueryRow(`select max(version) from schema_migrations`).Scan(&version)
+	is.NoErr(err)
+	return version
+}
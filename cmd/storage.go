@@ -3,12 +3,13 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 const (
@@ -26,6 +27,77 @@ const (
 			message_id integer not null
 		);
 	`
+	linksIndex = `
+		create index if not exists idx_links_chat_ts on links(chat_id, timestamp);
+	`
+	// the message id keeps the order of links posted within the same second
+	linksMessageIndex = `
+		drop index if exists idx_links_chat_ts;
+		create index if not exists idx_links_chat_ts_message on links(chat_id, timestamp, message_id);
+	`
+	linksCaption = `
+		alter table links add column caption text not null default '';
+	`
+	linksFileID = `
+		alter table links add column file_id text not null default '';
+	`
+	linksMediaGroup = `
+		alter table links add column media_group_id text not null default '';
+	`
+	chatSettingsTable = `
+		create table if not exists chat_settings (
+			chat_id integer not null primary key,
+			max_cols integer not null default 0,
+			min_images integer not null default 0,
+			tz text not null default '',
+			enabled integer not null default 1
+		);
+	`
+	chatSettingsTarget = `
+		alter table chat_settings add column target_chat_id integer not null default 0;
+	`
+	chatSettingsDeleteOriginals = `
+		alter table chat_settings add column delete_originals integer not null default 1;
+	`
+	chatSettingsSilent = `
+		alter table chat_settings add column silent integer not null default 0;
+	`
+	// empty output format means the default one
+	chatSettingsOutputFormat = `
+		alter table chat_settings add column output_format text not null default '';
+	`
+	// links of chats keeping the original photos are marked done instead of deleted
+	linksDone = `
+		alter table links add column done integer not null default 0;
+	`
+	// size of the downloaded photo, to tell why a collage looks low-res
+	linksPhotoSize = `
+		alter table links add column width integer not null default 0;
+		alter table links add column height integer not null default 0;
+		alter table links add column file_size integer not null default 0;
+	`
+	collagesTable = `
+		create table if not exists collages (
+			chat_id integer not null,
+			date text not null,
+			image_count integer not null,
+			sent_at integer not null
+		);
+	`
+	collagesIndex = `
+		create index if not exists idx_collages_chat on collages(chat_id, sent_at);
+	`
+	collagesLastLink = `
+		alter table collages add column last_link integer not null default 0;
+	`
+
+	insertLink = `insert into links (chat_id, timestamp, url, message_id, caption, file_id, media_group_id, width, height, file_size) values (?,?,?,?,?,?,?,?,?,?)`
+)
+
+const (
+	defaultBusyTimeout = 5 * time.Second
+	busyAttempts       = 5
+	busyBackoff        = 50 * time.Millisecond
 )
 
 type storage struct {
@@ -33,53 +105,308 @@ type storage struct {
 	db *sql.DB
 }
 
-func NewStorage(path string) (*storage, error) {
-	db, err := sql.Open("sqlite3", path)
+// StorageOption configures the storage.
+type StorageOption func(*storageOptions)
+
+type storageOptions struct {
+	busyTimeout time.Duration
+}
+
+// WithBusyTimeout sets how long a connection waits for a lock held by another one.
+func WithBusyTimeout(d time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		if d > 0 {
+			o.busyTimeout = d
+		}
+	}
+}
+
+func NewStorage(path string, opts ...StorageOption) (*storage, error) {
+	return NewStorageContext(context.Background(), path, opts...)
+}
+
+// NewStorageContext works like NewStorage but gives up setting up the database when ctx is done.
+func NewStorageContext(ctx context.Context, path string, opts ...StorageOption) (*storage, error) {
+	o := storageOptions{busyTimeout: defaultBusyTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// busy_timeout is a per connection pragma, the DSN applies it to every connection of the pool
+	dsn := path
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	dsn += fmt.Sprintf("%s_busy_timeout=%d", sep, o.busyTimeout.Milliseconds())
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open db file: %w", err)
 	}
 
-	if _, err := db.Exec(`PRAGMA journal_mode = WAL;`); err != nil {
+	err = setup(ctx, db, path)
+	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	if _, err := db.Exec(`PRAGMA synchronous = normal;`); err != nil {
-		return nil, err
+
+	return &storage{db: db}, nil
+}
+
+func setup(ctx context.Context, db *sql.DB, path string) error {
+	if isMemory(path) {
+		// every connection opens its own in-memory database, a single one keeps all data together
+		db.SetMaxOpenConns(1)
+	} else if _, err := db.ExecContext(ctx, `PRAGMA journal_mode = WAL;`); err != nil {
+		return err
 	}
-	if _, err := db.Exec(`PRAGMA temp_store = memory;`); err != nil {
-		return nil, err
+	if _, err := db.ExecContext(ctx, `PRAGMA synchronous = normal;`); err != nil {
+		return err
 	}
-
-	if _, err := db.Exec(chatsTable); err != nil {
-		return nil, fmt.Errorf("create chats table: %w", err)
+	if _, err := db.ExecContext(ctx, `PRAGMA temp_store = memory;`); err != nil {
+		return err
 	}
-	if _, err := db.Exec(linksTable); err != nil {
-		return nil, fmt.Errorf("create links table: %w", err)
+
+	if err := migrate(ctx, db); err != nil {
+		return fmt.Errorf("migrate: %w", err)
 	}
 
-	return &storage{db: db}, nil
+	return nil
+}
+
+// isMemory reports whether the path is an in-memory database, like ":memory:"
+// or "file:test?mode=memory&cache=shared".
+func isMemory(path string) bool {
+	return path == ":memory:" || strings.HasPrefix(path, "file::memory:") || strings.Contains(path, "mode=memory")
 }
 
 func (s *storage) RegisterChat(ctx context.Context, chatID int64, date time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	_, err := s.db.ExecContext(ctx, `insert into chats (chat_id, timestamp) values(?,?)`, chatID, date.Unix())
+	err := retryBusy(ctx, func() error {
+		_, err := s.db.ExecContext(ctx,
+			`insert into chats (chat_id, timestamp) values(?,?) on conflict(chat_id) do update set timestamp = excluded.timestamp`,
+			chatID, date.Unix(),
+		)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("register chat: %w", err)
 	}
 
+	return nil
+}
+
+// UnregisterChat deletes the chat with its links and settings.
+func (s *storage) UnregisterChat(ctx context.Context, chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"links", "chat_settings", "chats"} {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`delete from %s where chat_id = ?`, table), chatID)
+		if err != nil {
+			return fmt.Errorf("unregister chat from %s: %w", table, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit chat unregistration: %w", err)
+	}
+
+	return nil
+}
+
+// ErrUnknownChat is returned for links of chats that were never registered.
+var ErrUnknownChat = errors.New("unknown chat")
+
+func (s *storage) RegistreLink(ctx context.Context, l Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := chatExists(ctx, s.db, l.ChatID)
+	if err != nil {
+		return err
+	}
+
+	err = retryBusy(ctx, func() error {
+		_, err := s.db.ExecContext(ctx, insertLink, l.ChatID, l.Date.Unix(), l.URL, l.MessageID, l.Caption, l.FileID, l.MediaGroupID, l.Width, l.Height, l.FileSize)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("register new link: %w", err)
+	}
+
+	return nil
+}
+
+// retryBusy retries f a few times while the database is locked by another connection
+// for longer than the busy timeout, so bursts of writes don't drop links.
+func retryBusy(ctx context.Context, f func() error) error {
+	var err error
+	for attempt := 0; attempt < busyAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(busyBackoff << (attempt - 1)):
+			}
+		}
+		err = f()
+		if !isBusy(err) {
+			return err
+		}
+	}
 	return err
 }
 
-func (s *storage) RegistreLink(ctx context.Context, chatID, messageID int64, datetime time.Time, link string) error {
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// Link is a photo link posted to a chat.
+type Link struct {
+	ChatID    int64
+	MessageID int64
+	Date      time.Time
+	URL       string
+	Caption   string
+	// FileID is used to get a fresh URL as download links expire
+	FileID string
+	// MediaGroupID is shared by photos posted as one album
+	MediaGroupID string
+	// Width, Height and FileSize of the chosen photo size, zero if unknown
+	Width    int
+	Height   int
+	FileSize int
+}
+
+// RegisterLinks inserts all links in a single transaction.
+func (s *storage) RegisterLinks(ctx context.Context, links []Link) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	_, err := s.db.ExecContext(ctx, `insert into links (chat_id, timestamp, url, message_id) values (?,?,?,?)`,
-		chatID, datetime.Unix(), link, messageID,
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, insertLink)
+	if err != nil {
+		return fmt.Errorf("prepare links insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, l := range links {
+		err := chatExists(ctx, tx, l.ChatID)
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.ExecContext(ctx, l.ChatID, l.Date.Unix(), l.URL, l.MessageID, l.Caption, l.FileID, l.MediaGroupID, l.Width, l.Height, l.FileSize)
+		if err != nil {
+			return fmt.Errorf("register new link: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit links: %w", err)
+	}
+
+	return nil
+}
+
+// ChatSettings overrides the app settings for a chat, zero values mean the app defaults.
+type ChatSettings struct {
+	MaxCols   int
+	MinImages int
+	// TZ is the name of the zone the days of the chat are grouped by
+	TZ       string
+	Disabled bool
+	// TargetChatID is the chat collages are sent to instead of the chat of the photos
+	TargetChatID int64
+	// KeepOriginals leaves collaged photos in the chat
+	KeepOriginals bool
+	// Silent collages are sent without a notification
+	Silent bool
+	// OutputFormat of collages is "jpeg" or "png", JPEG if empty
+	OutputFormat string
+}
+
+// GetSettings returns the settings of the chat or zero settings if the chat has none.
+func (s *storage) GetSettings(ctx context.Context, chatID int64) (ChatSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		settings        ChatSettings
+		enabled         bool
+		deleteOriginals bool
 	)
+	err := s.db.QueryRowContext(ctx,
+		`select max_cols, min_images, tz, enabled, target_chat_id, delete_originals, silent, output_format from chat_settings where chat_id = ?`,
+		chatID,
+	).Scan(&settings.MaxCols, &settings.MinImages, &settings.TZ, &enabled, &settings.TargetChatID, &deleteOriginals, &settings.Silent, &settings.OutputFormat)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChatSettings{}, nil
+	}
 	if err != nil {
-		return fmt.Errorf("register new link: %w", err)
+		return ChatSettings{}, fmt.Errorf("select chat settings: %w", err)
+	}
+	settings.Disabled = !enabled
+	settings.KeepOriginals = !deleteOriginals
+
+	return settings, nil
+}
+
+func (s *storage) SetSettings(ctx context.Context, chatID int64, settings ChatSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx,
+		`insert into chat_settings (chat_id, max_cols, min_images, tz, enabled, target_chat_id, delete_originals, silent, output_format) values (?,?,?,?,?,?,?,?,?)
+		on conflict(chat_id) do update set
+			max_cols = excluded.max_cols,
+			min_images = excluded.min_images,
+			tz = excluded.tz,
+			enabled = excluded.enabled,
+			target_chat_id = excluded.target_chat_id,
+			delete_originals = excluded.delete_originals,
+			silent = excluded.silent,
+			output_format = excluded.output_format`,
+		chatID, settings.MaxCols, settings.MinImages, settings.TZ, !settings.Disabled, settings.TargetChatID, !settings.KeepOriginals, settings.Silent, settings.OutputFormat,
+	)
+	if err != nil {
+		return fmt.Errorf("set chat settings: %w", err)
+	}
+
+	return nil
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// chatExists returns ErrUnknownChat if the chat is not registered.
+func chatExists(ctx context.Context, db queryer, chatID int64) error {
+	var exists bool
+	err := db.QueryRowContext(ctx, `select exists(select 1 from chats where chat_id = ?)`, chatID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("check chat %d: %w", chatID, err)
+	}
+	if !exists {
+		return fmt.Errorf("register link of chat %d: %w", chatID, ErrUnknownChat)
 	}
 
 	return nil
@@ -89,7 +416,19 @@ func (s *storage) Chats(ctx context.Context) ([]int64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	rows, err := s.db.QueryContext(ctx, `select chat_id from chats`)
+	return s.chats(ctx, `select chat_id from chats`)
+}
+
+// ChatsWithPending returns the chats with links waiting for a collage.
+func (s *storage) ChatsWithPending(ctx context.Context) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.chats(ctx, `select chat_id from chats where exists (select 1 from links where links.chat_id = chats.chat_id and done = 0)`)
+}
+
+func (s *storage) chats(ctx context.Context, query string) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("select chats: %w", err)
 	}
@@ -108,16 +447,83 @@ func (s *storage) Chats(ctx context.Context) ([]int64, error) {
 	return chats, nil
 }
 
+// PendingCount returns the number of links waiting for a collage in the chat.
+func (s *storage) PendingCount(ctx context.Context, chatID int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, `select count(*) from links where chat_id = ? and done = 0`, chatID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count links: %w", err)
+	}
+
+	return count, nil
+}
+
+// OldestLink returns the time of the oldest link waiting for a collage in the chat
+// or sql.ErrNoRows if there are none.
+func (s *storage) OldestLink(ctx context.Context, chatID int64) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var timestamp sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `select min(timestamp) from links where chat_id = ? and done = 0`, chatID).Scan(&timestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("select oldest link: %w", err)
+	}
+	if !timestamp.Valid {
+		return time.Time{}, sql.ErrNoRows
+	}
+
+	return time.Unix(timestamp.Int64, 0), nil
+}
+
 type toCollage struct {
-	date  string
+	date string
+	// day is the start of the date in the zone the links are grouped by
+	day   time.Time
 	links []string
+	// captions of the links, empty if a photo was posted without one
+	captions []string
+	// telegram file ids of the links, empty for links stored before file ids were saved
+	fileIDs []string
+	// media group ids of the links, empty for photos posted outside of an album
+	mediaGroups []string
+	// messages of the day including ones with duplicate links
+	messages []int
+	// messages of each link, several ones if the same photo was posted again
+	linkMessages [][]int
+	// unix times of the links
+	times []int64
+	// unix time of the newest link of the day
+	last int64
+}
+
+// Links returns the links of the chat grouped by days in the loc zone.
+func (s *storage) Links(ctx context.Context, chatID int64, loc *time.Location) ([]int, []toCollage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.links(ctx, loc, `select timestamp, url, message_id, caption, file_id, media_group_id from links where chat_id = ? and done = 0 order by timestamp asc, message_id asc`, chatID)
 }
 
-func (s *storage) Links(ctx context.Context, chatID int64) ([]int, []toCollage, error) {
+// LinksBetween works like Links but returns only links posted within [from, to].
+func (s *storage) LinksBetween(ctx context.Context, chatID int64, loc *time.Location, from, to time.Time) ([]int, []toCollage, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	rows, err := s.db.QueryContext(ctx, `select timestamp, url, message_id from links where chat_id = ? order by timestamp asc`, chatID)
+	return s.links(ctx, loc,
+		`select timestamp, url, message_id, caption, file_id, media_group_id from links where chat_id = ? and done = 0 and timestamp between ? and ? order by timestamp asc, message_id asc`,
+		chatID, from.Unix(), to.Unix(),
+	)
+}
+
+// links runs the query selecting timestamp, url, message_id, caption, file_id
+// and media_group_id ordered by timestamp and message_id
+// and groups the links by day in the loc zone.
+func (s *storage) links(ctx context.Context, loc *time.Location, query string, args ...any) ([]int, []toCollage, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("select links: %w", err)
 	}
@@ -128,26 +534,46 @@ func (s *storage) Links(ctx context.Context, chatID int64) ([]int, []toCollage,
 		toCollageArr []toCollage
 		prevDate     string
 		i            = -1
+		// indexes of links already added to the current day, the same photo may be posted twice
+		seen map[string]int
 	)
 	for rows.Next() {
 		var (
 			messageID int
 			link      string
+			caption   string
+			fileID    string
+			group     string
 			timestamp int64
 		)
-		err := rows.Scan(&timestamp, &link, &messageID)
+		err := rows.Scan(&timestamp, &link, &messageID, &caption, &fileID, &group)
 		if err != nil {
 			return nil, nil, fmt.Errorf("scan links: %w", err)
 		}
 
 		messages = append(messages, messageID)
-		date := time.Unix(timestamp, 0).Format(time.DateOnly)
+		t := time.Unix(timestamp, 0).In(loc)
+		date := t.Format(time.DateOnly)
 		if prevDate != date {
-			toCollageArr = append(toCollageArr, toCollage{date: date})
+			day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+			toCollageArr = append(toCollageArr, toCollage{date: date, day: day})
 			prevDate = date
+			seen = make(map[string]int)
 			i++
 		}
+		toCollageArr[i].messages = append(toCollageArr[i].messages, messageID)
+		toCollageArr[i].last = timestamp
+		if j, ok := seen[link]; ok {
+			toCollageArr[i].linkMessages[j] = append(toCollageArr[i].linkMessages[j], messageID)
+			continue
+		}
+		seen[link] = len(toCollageArr[i].links)
+		toCollageArr[i].linkMessages = append(toCollageArr[i].linkMessages, []int{messageID})
+		toCollageArr[i].times = append(toCollageArr[i].times, timestamp)
 		toCollageArr[i].links = append(toCollageArr[i].links, link)
+		toCollageArr[i].captions = append(toCollageArr[i].captions, caption)
+		toCollageArr[i].fileIDs = append(toCollageArr[i].fileIDs, fileID)
+		toCollageArr[i].mediaGroups = append(toCollageArr[i].mediaGroups, group)
 	}
 
 	if len(messages) == 0 {
@@ -157,7 +583,98 @@ func (s *storage) Links(ctx context.Context, chatID int64) ([]int, []toCollage,
 	return messages, toCollageArr, nil
 }
 
-func (s *storage) DeleteMessages(ctx context.Context, messages []int) error {
+// Collage is a record of a sent collage.
+type Collage struct {
+	ChatID int64
+	// Date is the day of the photos
+	Date       string
+	ImageCount int
+	SentAt     time.Time
+	// LastLink is the posting time of the newest photo in the collage
+	LastLink time.Time
+}
+
+func (s *storage) AddCollage(ctx context.Context, c Collage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lastLink int64
+	if !c.LastLink.IsZero() {
+		lastLink = c.LastLink.Unix()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`insert into collages (chat_id, date, image_count, sent_at, last_link) values (?,?,?,?,?)`,
+		c.ChatID, c.Date, c.ImageCount, c.SentAt.Unix(), lastLink,
+	)
+	if err != nil {
+		return fmt.Errorf("add collage: %w", err)
+	}
+
+	return nil
+}
+
+// CollagedUntil returns the posting time of the newest photo collaged for the day,
+// zero time if no collage was sent for it.
+func (s *storage) CollagedUntil(ctx context.Context, chatID int64, date string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `select max(last_link) from collages where chat_id = ? and date = ?`, chatID, date).Scan(&last)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("select collaged until: %w", err)
+	}
+	if !last.Valid || last.Int64 == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(last.Int64, 0), nil
+}
+
+// CollageHistory returns collages sent to the chat, the latest first.
+func (s *storage) CollageHistory(ctx context.Context, chatID int64) ([]Collage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx,
+		`select date, image_count, sent_at, last_link from collages where chat_id = ? order by sent_at desc, rowid desc`,
+		chatID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select collages: %w", err)
+	}
+	defer rows.Close()
+
+	var collages []Collage
+	for rows.Next() {
+		c := Collage{ChatID: chatID}
+		var sentAt, lastLink int64
+		err := rows.Scan(&c.Date, &c.ImageCount, &sentAt, &lastLink)
+		if err != nil {
+			return nil, fmt.Errorf("scan collage: %w", err)
+		}
+		c.SentAt = time.Unix(sentAt, 0)
+		if lastLink != 0 {
+			c.LastLink = time.Unix(lastLink, 0)
+		}
+		collages = append(collages, c)
+	}
+
+	return collages, rows.Err()
+}
+
+// DeleteMessages deletes links of the messages of the chat,
+// message ids are unique within a chat only.
+func (s *storage) DeleteMessages(ctx context.Context, chatID int64, messages []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return deleteMessages(ctx, s.db, chatID, messages)
+}
+
+// MarkDone marks links of the messages collaged, so they are not collaged again
+// while the messages are kept in the chat.
+func (s *storage) MarkDone(ctx context.Context, chatID int64, messages []int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -166,17 +683,43 @@ func (s *storage) DeleteMessages(ctx context.Context, messages []int) error {
 	}
 
 	placeholders := make([]string, len(messages))
-	for i := range messages {
+	args := make([]any, 0, len(messages)+1)
+	args = append(args, chatID)
+	for i, id := range messages {
 		placeholders[i] = "?"
+		args = append(args, id)
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		fmt.Sprintf("update links set done = 1 where chat_id = ? and message_id in (%s)", strings.Join(placeholders, ", ")),
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("mark links done: %w", err)
+	}
+
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func deleteMessages(ctx context.Context, db execer, chatID int64, messages []int) error {
+	if len(messages) == 0 {
+		return nil
 	}
 
-	args := make([]interface{}, len(messages))
+	placeholders := make([]string, len(messages))
+	args := make([]any, 0, len(messages)+1)
+	args = append(args, chatID)
 	for i, id := range messages {
-		args[i] = id
+		placeholders[i] = "?"
+		args = append(args, id)
 	}
 
-	_, err := s.db.ExecContext(ctx,
-		fmt.Sprintf("delete from links where message_id in (%s)", strings.Join(placeholders, ", ")),
+	_, err := db.ExecContext(ctx,
+		fmt.Sprintf("delete from links where chat_id = ? and message_id in (%s)", strings.Join(placeholders, ", ")),
 		args...,
 	)
 	if err != nil {
@@ -186,6 +729,35 @@ func (s *storage) DeleteMessages(ctx context.Context, messages []int) error {
 	return nil
 }
 
+// Maintain moves the WAL into the database file and rebuilds it
+// to give the space of deleted links back to the file system.
+func (s *storage) Maintain(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE);`)
+	if err != nil {
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `VACUUM;`)
+	if err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+
+	return nil
+}
+
+// Ping checks the database is reachable.
+func (s *storage) Ping(ctx context.Context) error {
+	err := s.db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("ping db: %w", err)
+	}
+
+	return nil
+}
+
 func (s *storage) Close() error {
 	return s.db.Close()
 }
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestStorageLinksUsesIndex(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+
+	rows, err := s.db.QueryContext(context.TODO(), `explain query plan select timestamp, url, message_id from links where chat_id = ? order by timestamp asc, message_id asc`, 1337)
+	is.NoErr(err)
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var (
+			id, parent, notused int
+			detail              string
+		)
+		is.NoErr(rows.Scan(&id, &parent, &notused, &detail))
+		plan = append(plan, detail)
+	}
+	is.NoErr(rows.Err())
+
+	is.True(strings.Contains(strings.Join(plan, "\n"), "idx_links_chat_ts_message"))
+	is.True(!strings.Contains(strings.Join(plan, "\n"), "TEMP B-TREE")) // no sorting
+}
+
+func TestStorageRegisterChatTwice(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+
+	err := s.RegisterChat(context.TODO(), 1337, time.Unix(100, 0))
+	is.NoErr(err)
+	err = s.RegisterChat(context.TODO(), 1337, time.Unix(200, 0))
+	is.NoErr(err)
+
+	chats, err := s.Chats(context.TODO())
+	is.NoErr(err)
+	is.Equal([]int64{1337}, chats)
+
+	var timestamp int64
+	is.NoErr(s.db.QueryRow(`select timestamp from chats where chat_id = 1337`).Scan(&timestamp))
+	is.Equal(int64(200), timestamp)
+}
+
+func TestStorageChatsWithPending(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	for _, chatID := range []int64{42, 43, 44} {
+		is.NoErr(s.RegisterChat(ctx, chatID, time.Unix(100, 0)))
+	}
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+	is.NoErr(s.RegisterLinks(ctx, []Link{
+		{ChatID: 1337, MessageID: 1, Date: day, URL: "http://a"},
+		{ChatID: 1337, MessageID: 2, Date: day, URL: "http://b"},
+		{ChatID: 43, MessageID: 3, Date: day, URL: "http://c"},
+		{ChatID: 44, MessageID: 4, Date: day, URL: "http://d"},
+	}))
+	// collaged links are not pending
+	is.NoErr(s.MarkDone(ctx, 44, []int{4}))
+
+	chats, err := s.ChatsWithPending(ctx)
+	is.NoErr(err)
+	slices.Sort(chats)
+	is.Equal([]int64{43, 1337}, chats)
+}
+
+func TestStorageLinksDeduplicatesPerDay(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 1, Date: day, URL: "http://a"}))
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 2, Date: day.Add(time.Minute), URL: "http://a"}))
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 3, Date: day.Add(2 * time.Minute), URL: "http://b"}))
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 4, Date: day.AddDate(0, 0, 1), URL: "http://a"}))
+
+	messages, toCollage, err := s.Links(ctx, 1337, time.Local)
+	is.NoErr(err)
+	is.Equal([]int{1, 2, 3, 4}, messages) // duplicates are still cleaned up
+	is.Equal(2, len(toCollage))
+	is.Equal([]string{"http://a", "http://b"}, toCollage[0].links)
+	is.Equal([][]int{{1, 2}, {3}}, toCollage[0].linkMessages)
+	is.Equal([]int64{day.Unix(), day.Add(2 * time.Minute).Unix()}, toCollage[0].times)
+	is.Equal([]string{"http://a"}, toCollage[1].links) // the same link on another day is kept
+}
+
+func TestStorageLinksOrderedByMessage(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	// album photos are posted within the same second but may be stored out of order
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+	for _, id := range []int64{3, 1, 2} {
+		is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: id, Date: day, URL: fmt.Sprintf("http://%d", id)}))
+	}
+
+	messages, toCollage, err := s.Links(ctx, 1337, time.Local)
+	is.NoErr(err)
+	is.Equal([]int{1, 2, 3}, messages)
+	is.Equal([]string{"http://1", "http://2", "http://3"}, toCollage[0].links)
+}
+
+func TestStorageRegisterLinks(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+	links := make([]Link, 100)
+	for i := range links {
+		links[i] = Link{
+			ChatID:    1337,
+			MessageID: int64(i + 1),
+			Date:      day.Add(time.Duration(i) * time.Second),
+			URL:       fmt.Sprintf("http://link/%d", i),
+		}
+	}
+
+	err := s.RegisterLinks(ctx, links)
+	is.NoErr(err)
+
+	messages, toCollage, err := s.Links(ctx, 1337, time.Local)
+	is.NoErr(err)
+	is.Equal(100, len(messages))
+	is.Equal(1, len(toCollage))
+	is.Equal(100, len(toCollage[0].links))
+	is.Equal("http://link/99", toCollage[0].links[99])
+}
+
+func TestStorageLinksBetween(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	day := time.Date(2024, time.August, 31, 0, 0, 0, 0, time.Local)
+	for i := range 3 {
+		date := day.AddDate(0, 0, i)
+		is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: int64(2*i + 1), Date: date.Add(time.Hour), URL: fmt.Sprintf("http://%d/a", i)}))
+		is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: int64(2*i + 2), Date: date.Add(23 * time.Hour), URL: fmt.Sprintf("http://%d/b", i)}))
+	}
+
+	from := day.AddDate(0, 0, 1)
+	to := from.AddDate(0, 0, 1).Add(-time.Second)
+	messages, toCollage, err := s.LinksBetween(ctx, 1337, time.Local, from, to)
+	is.NoErr(err)
+	is.Equal([]int{3, 4}, messages)
+	is.Equal(1, len(toCollage))
+	is.Equal("2024-09-01", toCollage[0].date)
+	is.Equal([]string{"http://1/a", "http://1/b"}, toCollage[0].links)
+
+	_, _, err = s.LinksBetween(ctx, 1337, time.Local, day.AddDate(0, 0, 5), day.AddDate(0, 0, 6))
+	is.Equal(sql.ErrNoRows, err)
+}
+
+func TestStorageLinksZone(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	loc, err := time.LoadLocation("Europe/Moscow")
+	is.NoErr(err)
+
+	// different UTC days, but the same day in Moscow
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 1, Date: time.Date(2024, time.August, 31, 22, 0, 0, 0, time.UTC), URL: "http://a"}))
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 2, Date: time.Date(2024, time.September, 1, 1, 0, 0, 0, time.UTC), URL: "http://b"}))
+
+	_, toCollage, err := s.Links(ctx, 1337, loc)
+	is.NoErr(err)
+	is.Equal(1, len(toCollage))
+	is.Equal("2024-09-01", toCollage[0].date)
+	is.Equal([]string{"http://a", "http://b"}, toCollage[0].links)
+	is.Equal(time.Date(2024, time.September, 1, 0, 0, 0, 0, loc), toCollage[0].day)
+
+	_, toCollage, err = s.Links(ctx, 1337, time.UTC)
+	is.NoErr(err)
+	is.Equal(2, len(toCollage))
+	for _, item := range toCollage {
+		day, err := time.ParseInLocation(time.DateOnly, item.date, time.UTC)
+		is.NoErr(err)
+		is.True(day.Equal(item.day))
+	}
+}
+
+func TestStorageSettings(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	settings, err := s.GetSettings(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(ChatSettings{}, settings)
+
+	want := ChatSettings{MaxCols: 3, MinImages: 4, TZ: "Asia/Tokyo", Disabled: true, TargetChatID: -100500, KeepOriginals: true, Silent: true, OutputFormat: "png"}
+	is.NoErr(s.SetSettings(ctx, 1337, want))
+	settings, err = s.GetSettings(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(want, settings)
+
+	want = ChatSettings{MaxCols: 2}
+	is.NoErr(s.SetSettings(ctx, 1337, want))
+	settings, err = s.GetSettings(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(want, settings)
+}
+
+func TestStorageCollageHistory(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	history, err := s.CollageHistory(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(0, len(history))
+
+	sentAt := time.Unix(1725100000, 0)
+	want := Collage{ChatID: 1337, Date: "2024-08-31", ImageCount: 12, SentAt: sentAt}
+	is.NoErr(s.AddCollage(ctx, want))
+	is.NoErr(s.AddCollage(ctx, Collage{ChatID: 42, Date: "2024-08-31", ImageCount: 3, SentAt: sentAt}))
+
+	history, err = s.CollageHistory(ctx, 1337)
+	is.NoErr(err)
+	is.Equal([]Collage{want}, history)
+}
+
+func TestStoragePendingCount(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	count, err := s.PendingCount(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(0, count)
+
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+	for i := range 5 {
+		is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: int64(i), Date: day, URL: fmt.Sprintf("http://%d", i)}))
+	}
+	is.NoErr(s.RegisterChat(ctx, 42, day))
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 42, MessageID: 1, Date: day, URL: "http://other"}))
+
+	count, err = s.PendingCount(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(5, count)
+
+	oldest, err := s.OldestLink(ctx, 1337)
+	is.NoErr(err)
+	is.True(oldest.Equal(day))
+
+	_, err = s.OldestLink(ctx, 7)
+	is.Equal(sql.ErrNoRows, err)
+}
+
+func TestStorageLinkCaption(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 1, Date: day, URL: "http://a", Caption: "breakfast"}))
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 2, Date: day.Add(time.Hour), URL: "http://b"}))
+
+	_, toCollage, err := s.Links(ctx, 1337, time.Local)
+	is.NoErr(err)
+	is.Equal([]string{"http://a", "http://b"}, toCollage[0].links)
+	is.Equal([]string{"breakfast", ""}, toCollage[0].captions)
+}
+
+func TestStorageUnknownChat(t *testing.T) {
+	is := is.New(t)
+
+	s := newTestStorage(t, is)
+	ctx := context.TODO()
+
+	err := s.RegistreLink(ctx, Link{ChatID: 42, MessageID: 1, Date: time.Now(), URL: "http://a"})
+	is.True(errors.Is(err, ErrUnknownChat))
+
+	err = s.RegisterLinks(ctx, []Link{
+		{ChatID: 1337, MessageID: 1, Date: time.Now(), URL: "http://a"},
+		{ChatID: 42, MessageID: 2, Date: time.Now(), URL: "http://b"},
+	})
+	is.True(errors.Is(err, ErrUnknownChat))
+
+	// nothing is inserted if any of the chats is unknown
+	count, err := s.PendingCount(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(0, count)
+}
+
+func TestStorageMaintain(t *testing.T) {
+	is := is.New(t)
+
+	dbPath := path.Join(t.TempDir(), "collagify.sqlite")
+	s, err := NewStorage(dbPath)
+	is.NoErr(err)
+	t.Cleanup(func() { s.Close() })
+
+	size := func() int64 {
+		var total int64
+		for _, suffix := range []string{"", "-wal"} {
+			info, err := os.Stat(dbPath + suffix)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			is.NoErr(err)
+			total += info.Size()
+		}
+		return total
+	}
+
+	ctx := context.TODO()
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+	is.NoErr(s.RegisterChat(ctx, 1337, day))
+
+	links := make([]Link, 2000)
+	messages := make([]int, len(links))
+	for i := range links {
+		links[i] = Link{ChatID: 1337, MessageID: int64(i), Date: day, URL: fmt.Sprintf("http://%d/%s", i, strings.Repeat("x", 200))}
+		messages[i] = i
+	}
+	is.NoErr(s.RegisterLinks(ctx, links))
+	for batch := range slices.Chunk(messages, 500) {
+		is.NoErr(s.DeleteMessages(ctx, 1337, batch))
+	}
+
+	before := size()
+	is.NoErr(s.Maintain(ctx))
+	is.True(size() < before)
+}
+
+func TestNewStorageContextCancelled(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	start := time.Now()
+	_, err := NewStorageContext(ctx, path.Join(t.TempDir(), "db.sqlite"))
+	is.True(errors.Is(err, context.Canceled))
+	is.True(time.Since(start) < time.Second)
+}
+
+func TestStorageRetriesBusy(t *testing.T) {
+	is := is.New(t)
+
+	ctx := context.TODO()
+	file := path.Join(t.TempDir(), "db.sqlite")
+	s, err := NewStorage(file, WithBusyTimeout(10*time.Millisecond))
+	is.NoErr(err)
+	t.Cleanup(func() { s.Close() })
+	is.NoErr(s.RegisterChat(ctx, 1337, time.Unix(100, 0)))
+
+	other, err := sql.Open("sqlite3", file)
+	is.NoErr(err)
+	t.Cleanup(func() { other.Close() })
+	conn, err := other.Conn(ctx)
+	is.NoErr(err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.ExecContext(ctx, `begin immediate`)
+	is.NoErr(err)
+
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		time.Sleep(200 * time.Millisecond)
+		conn.ExecContext(ctx, `commit`)
+	}()
+
+	start := time.Now()
+	is.NoErr(s.RegistreLink(ctx, Link{ChatID: 1337, MessageID: 1, Date: time.Unix(200, 0), URL: "http://a"}))
+	is.NoErr(s.RegisterChat(ctx, 42, time.Unix(300, 0)))
+	is.True(time.Since(start) >= 200*time.Millisecond) // the writes waited for the lock
+	<-released
+
+	count, err := s.PendingCount(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(1, count)
+	chats, err := s.Chats(ctx)
+	is.NoErr(err)
+	is.Equal([]int64{42, 1337}, chats)
+}
+
+func TestStorageInMemory(t *testing.T) {
+	is := is.New(t)
+
+	for _, dsn := range []string{":memory:", "file:collagify?mode=memory&cache=shared"} {
+		s, err := NewStorage(dsn)
+		is.NoErr(err)
+
+		ctx := context.TODO()
+		day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.Local)
+		is.NoErr(s.RegisterChat(ctx, 1337, day))
+		is.NoErr(s.RegisterLinks(ctx, []Link{
+			{ChatID: 1337, MessageID: 1, Date: day, URL: "http://a"},
+			{ChatID: 1337, MessageID: 2, Date: day.Add(time.Minute), URL: "http://b"},
+		}))
+
+		messages, toCollage, err := s.Links(ctx, 1337, time.Local)
+		is.NoErr(err)
+		is.Equal([]int{1, 2}, messages)
+		is.Equal([]string{"http://a", "http://b"}, toCollage[0].links)
+
+		is.NoErr(s.DeleteMessages(ctx, 1337, messages))
+		_, _, err = s.Links(ctx, 1337, time.Local)
+		is.Equal(sql.ErrNoRows, err)
+
+		is.NoErr(s.Close())
+	}
+}
+
+func TestStorageDeleteMessagesOfChat(t *testing.T) {
+	is := is.New(t)
+
+	ctx := context.TODO()
+	s := newTestStorage(t, is)
+	is.NoErr(s.RegisterChat(ctx, 42, time.Unix(100, 0)))
+
+	// message ids are unique within a chat only
+	day := time.Date(2024, time.August, 31, 12, 0, 0, 0, time.UTC)
+	is.NoErr(s.RegisterLinks(ctx, []Link{
+		{ChatID: 1337, MessageID: 1, Date: day, URL: "http://a"},
+		{ChatID: 42, MessageID: 1, Date: day, URL: "http://b"},
+	}))
+
+	is.NoErr(s.DeleteMessages(ctx, 1337, []int{1}))
+
+	pending, err := s.PendingCount(ctx, 1337)
+	is.NoErr(err)
+	is.Equal(0, pending)
+	pending, err = s.PendingCount(ctx, 42)
+	is.NoErr(err)
+	is.Equal(1, pending)
+}
+
+func newTestStorage(t *testing.T, is *is.I) *storage {
+	t.Helper()
+
+	s, err := NewStorage(":memory:")
+	is.NoErr(err)
+	t.Cleanup(func() { s.Close() })
+
+	// the chat links of the tests are registered in
+	is.NoErr(s.RegisterChat(context.TODO(), 1337, time.Unix(100, 0)))
+
+	return s
+}
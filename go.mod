@@ -8,3 +8,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/robfig/cron/v3 v3.0.0
 )
+
+require golang.org/x/image v0.24.0
+
+require golang.org/x/text v0.22.0 // indirect
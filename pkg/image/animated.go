@@ -0,0 +1,58 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+// ConcatAnimated makes a GIF that cycles through images, showing each one
+// for delay hundredths of a second. Every frame is scaled to fit the size of the
+// first image keeping its aspect ratio, the leftover space is filled with the background.
+// Only WithBackground, WithInterpolator, WithMaxDimension, WithCellSize and WithConcurrency apply.
+func ConcatAnimated(images [][]byte, delay int, opts ...Option) ([]byte, error) {
+	if len(images) == 0 {
+		return nil, fmt.Errorf("concat animated: %w", ErrNoImages)
+	}
+	if delay < 0 {
+		return nil, fmt.Errorf("invalid frame delay %d", delay)
+	}
+
+	o := newOptions(opts)
+	o.skipInvalid = false
+	imgs, skipped := decodeAll(images, o)
+	if skipped != nil {
+		return nil, fmt.Errorf("concat animated: %w", skipped.Err)
+	}
+
+	// frames are sized like a single cell, then limited like a collage
+	w, h := imageSize(imgs[0], o)
+	w, h = downscaledSize(w, h, o)
+	size := image.Rect(0, 0, w, h)
+
+	anim := &gif.GIF{}
+	for _, img := range imgs {
+		// scale into a true color image first, so the frame is dithered once
+		r := containRect(img.Bounds(), size)
+		scaled := image.NewRGBA(size)
+		draw.Draw(scaled, size, &image.Uniform{o.background}, image.Point{}, draw.Src)
+		drawCell(scaled, r, img, img.Bounds(), options{interpolator: o.interpolator})
+		frame := image.NewPaletted(size, palette.Plan9)
+		draw.FloydSteinberg.Draw(frame, size, scaled, image.Point{})
+
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+	}
+
+	buf := &bytes.Buffer{}
+	err := gif.EncodeAll(buf, anim)
+	if err != nil {
+		return nil, fmt.Errorf("encode gif: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
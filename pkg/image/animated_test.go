@@ -0,0 +1,54 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestConcatAnimated(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{
+		newJPEG(is, 100, 80, color.RGBA{R: 255, A: 255}),
+		newPNG(is, 200, 50, color.RGBA{G: 255, A: 255}),
+		newJPEG(is, 50, 200, color.RGBA{B: 255, A: 255}),
+	}
+
+	anim, err := ConcatAnimated(images, 150)
+	is.NoErr(err)
+
+	g, err := gif.DecodeAll(bytes.NewReader(anim))
+	is.NoErr(err)
+	is.Equal(3, len(g.Image))
+	is.Equal([]int{150, 150, 150}, g.Delay)
+	for _, frame := range g.Image {
+		is.Equal(100, frame.Bounds().Dx()) // frames have the size of the first image
+		is.Equal(80, frame.Bounds().Dy())
+	}
+
+	// the first frame is red, the second one is green letterboxed with the background
+	r, gr, b, _ := g.Image[0].At(50, 40).RGBA()
+	is.True(r > 0xf000 && gr < 0x1000 && b < 0x1000)
+	r, gr, b, _ = g.Image[1].At(50, 40).RGBA()
+	is.True(r < 0x1000 && gr > 0xf000 && b < 0x1000)
+	r, gr, b, _ = g.Image[1].At(50, 2).RGBA()
+	is.True(r > 0xf000 && gr > 0xf000 && b > 0xf000)
+
+	anim, err = ConcatAnimated(images, 100, WithMaxDimension(50))
+	is.NoErr(err)
+	g, err = gif.DecodeAll(bytes.NewReader(anim))
+	is.NoErr(err)
+	is.Equal(50, g.Config.Width)
+	is.Equal(40, g.Config.Height)
+
+	_, err = ConcatAnimated(nil, 100)
+	is.True(errors.Is(err, ErrNoImages))
+
+	_, err = ConcatAnimated([][]byte{[]byte("garbage")}, 100)
+	is.True(err != nil)
+}
@@ -0,0 +1,59 @@
+package image
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// blurDownscale is how many times the background is shrunk before blurring,
+// blurring a small image and scaling it up is much cheaper and looks the same.
+const blurDownscale = 8
+
+// drawBlurFill covers the cell with a blurred copy of the image cropped to the cell aspect ratio.
+func drawBlurFill(dst draw.Image, cell image.Rectangle, img image.Image) {
+	small := image.NewRGBA(image.Rect(0, 0, max(1, cell.Dx()/blurDownscale), max(1, cell.Dy()/blurDownscale)))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, cropRect(img.Bounds(), cell), draw.Src, nil)
+
+	boxBlur(small, max(1, min(small.Bounds().Dx(), small.Bounds().Dy())/8))
+
+	draw.BiLinear.Scale(dst, cell, small, small.Bounds(), draw.Src, nil)
+}
+
+// boxBlur blurs the image in place with a box of the given radius.
+// The blur is separable, so it's done with a horizontal and a vertical pass.
+func boxBlur(img *image.RGBA, radius int) {
+	b := img.Bounds()
+	tmp := make([]uint8, len(img.Pix))
+
+	blurPass(img.Pix, tmp, b.Dx(), b.Dy(), img.Stride, 4, radius)
+	blurPass(tmp, img.Pix, b.Dy(), b.Dx(), 4, img.Stride, radius)
+}
+
+// blurPass averages pixels of every line in a window of 2*radius+1 pixels.
+// step is the distance in bytes between neighbor pixels of a line and
+// lineStep is the distance between starts of lines.
+func blurPass(src, dst []uint8, length, lines, lineStep, step, radius int) {
+	for l := 0; l < lines; l++ {
+		start := l * lineStep
+		for c := 0; c < 4; c++ {
+			var sum, count int
+			// prefill the window on the right of the first pixel
+			for i := 0; i < min(radius, length); i++ {
+				sum += int(src[start+i*step+c])
+				count++
+			}
+			for i := 0; i < length; i++ {
+				if right := i + radius; right < length {
+					sum += int(src[start+right*step+c])
+					count++
+				}
+				if left := i - radius - 1; left >= 0 {
+					sum -= int(src[start+left*step+c])
+					count--
+				}
+				dst[start+i*step+c] = uint8(sum / count)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/image/draw"
+)
+
+func TestConcatBlurFill(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+
+	// 2:1 image with red left and blue right halves
+	wide := newImage(200, 100, red)
+	draw.Draw(wide, image.Rect(100, 0, 200, 100), &image.Uniform{blue}, image.Point{}, draw.Src)
+
+	images := []image.Image{newImage(100, 100, red), wide}
+
+	collage := concat(images, 1, 2, newOptions([]Option{WithFit(FitContain)}))
+	is.Equal(white, collage.At(100, 0))
+	is.Equal(white, collage.At(199, 0))
+
+	collage = concat(images, 1, 2, newOptions([]Option{WithFit(FitContain), WithBlurFill(true)}))
+	is.True(collage.At(100, 0) != white)
+	is.True(collage.At(100, 0) != collage.At(199, 0)) // not a flat color
+	is.True(collage.At(100, 99) != collage.At(199, 99))
+
+	// the image itself is drawn over the blurred fill
+	is.Equal(red, collage.At(120, 50))
+	is.Equal(blue, collage.At(180, 50))
+}
+
+func TestBoxBlur(t *testing.T) {
+	is := is.New(t)
+
+	img := image.NewRGBA(image.Rect(0, 0, 9, 9))
+	img.Set(4, 4, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+
+	boxBlur(img, 1)
+
+	// the single bright pixel is spread to the 3x3 box
+	is.Equal(color.RGBA{R: 28, G: 28, B: 28, A: 28}, img.At(3, 3))
+	is.Equal(color.RGBA{R: 28, G: 28, B: 28, A: 28}, img.At(4, 4))
+	is.Equal(color.RGBA{}, img.At(2, 4))
+}
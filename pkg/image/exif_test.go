@@ -0,0 +1,114 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/image/draw"
+)
+
+func TestOrient(t *testing.T) {
+	is := is.New(t)
+
+	var (
+		red   = color.RGBA{R: 255, A: 255}
+		green = color.RGBA{G: 255, A: 255}
+		blue  = color.RGBA{B: 255, A: 255}
+		white = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	)
+
+	// 3x2 image with colored corners
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(0, 0, red)
+	src.Set(2, 0, green)
+	src.Set(0, 1, blue)
+	src.Set(2, 1, white)
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		topLeft     color.Color
+	}{
+		{1, image.Pt(3, 2), red},
+		{2, image.Pt(3, 2), green},
+		{3, image.Pt(3, 2), white},
+		{4, image.Pt(3, 2), blue},
+		{5, image.Pt(2, 3), red},
+		{6, image.Pt(2, 3), blue},
+		{7, image.Pt(2, 3), white},
+		{8, image.Pt(2, 3), green},
+	}
+	for _, tt := range tests {
+		img := orient(src, tt.orientation)
+		is.Equal(tt.size, img.Bounds().Size())
+		is.Equal(tt.topLeft, img.At(img.Bounds().Min.X, img.Bounds().Min.Y))
+	}
+}
+
+func TestDecodeOrientation(t *testing.T) {
+	is := is.New(t)
+
+	// left half is red, right half is blue
+	src := newImage(40, 20, color.RGBA{R: 255, A: 255})
+	draw.Draw(src, image.Rect(20, 0, 40, 20), &image.Uniform{color.RGBA{B: 255, A: 255}}, image.Point{}, draw.Src)
+
+	buf := &bytes.Buffer{}
+	is.NoErr(jpeg.Encode(buf, src, &jpeg.Options{Quality: 100}))
+
+	img, err := decode(buf.Bytes())
+	is.NoErr(err)
+	is.Equal(image.Pt(40, 20), img.Bounds().Size()) // no exif, as is
+
+	// rotated clockwise: the left half goes to the top
+	img, err = decode(withOrientation(buf.Bytes(), 6))
+	is.NoErr(err)
+	is.Equal(image.Pt(20, 40), img.Bounds().Size())
+	is.True(isRed(img.At(10, 5)))
+	is.True(!isRed(img.At(10, 35)))
+
+	// rotated counterclockwise: the right half goes to the top
+	img, err = decode(withOrientation(buf.Bytes(), 8))
+	is.NoErr(err)
+	is.Equal(image.Pt(20, 40), img.Bounds().Size())
+	is.True(!isRed(img.At(10, 5)))
+	is.True(isRed(img.At(10, 35)))
+}
+
+func TestOrientationWithoutExif(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(1, orientation(nil))
+	is.Equal(1, orientation([]byte("garbage")))
+	is.Equal(1, orientation(newJPEG(is, 10, 10, color.White)))
+}
+
+// withOrientation inserts an APP1 EXIF segment with the given orientation right after SOI.
+func withOrientation(b []byte, o int) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)              // entries count
+	tiff = binary.BigEndian.AppendUint16(tiff, orientationTag) // tag
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)              // type SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)              // count
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(o))      // value
+	tiff = append(tiff, 0, 0)                                  // value padding
+	tiff = append(tiff, 0, 0, 0, 0)                            // next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, b[:2]...)
+	out = append(out, segment...)
+	return append(out, b[2:]...)
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xC000 && b < 0x4000
+}
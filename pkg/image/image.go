@@ -2,71 +2,961 @@ package image
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
-	"image/draw"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font/opentype"
+	_ "golang.org/x/image/webp"
+)
+
+// Option configures how Concat builds a collage.
+type Option func(*options)
+
+// Fit defines how an image is placed into its grid cell.
+type Fit int
+
+const (
+	// FitStretch scales an image to fill the whole cell ignoring its aspect ratio.
+	FitStretch Fit = iota
+	// FitContain scales an image to fit inside the cell keeping its aspect ratio,
+	// the leftover space is filled with the background.
+	FitContain
+	// FitCrop scales an image to cover the whole cell keeping its aspect ratio,
+	// the overflow is cropped evenly from both sides.
+	FitCrop
+)
+
+// Layout defines how images are arranged in the collage.
+type Layout int
+
+const (
+	// LayoutGrid places images into equal cells of a rows by cols grid.
+	LayoutGrid Layout = iota
+	// LayoutJustified keeps the aspect ratio of images and packs them into rows
+	// as wide as the grid, every full row is scaled to fill the width exactly.
+	LayoutJustified
+)
+
+// Format is an encoding of the resulting collage.
+type Format int
+
+const (
+	FormatJPEG Format = iota
+	FormatPNG
+)
+
+// DefaultQuality is the JPEG quality used when none is set.
+const DefaultQuality = 85
+
+type options struct {
+	interpolator draw.Interpolator
+	fit          Fit
+	layout       Layout
+	background   color.Color
+	padding      int
+	border       bool
+	format       Format
+	quality      int
+	skipInvalid  bool
+	concurrency  int
+	centerLast   bool
+	maxDimension int
+	cellWidth    int
+	cellHeight   int
+	maxSideSum   int
+	maxRatio     float64
+	title        string
+	// titleHeight is chosen by the title face if zero
+	titleHeight        int
+	font               *opentype.Font
+	fontSize           float64
+	labelCells         bool
+	cornerRadius       int
+	borderWidth        int
+	borderColor        color.Color
+	blurFill           bool
+	progressive        bool
+	progressiveEncoder ProgressiveEncoder
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		interpolator: draw.BiLinear,
+		background:   color.White,
+		quality:      DefaultQuality,
+		concurrency:  runtime.GOMAXPROCS(0),
+		borderColor:  color.Black,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// WithInterpolator sets the interpolator used to scale images to the cell size.
+func WithInterpolator(i draw.Interpolator) Option {
+	return func(o *options) {
+		if i != nil {
+			o.interpolator = i
+		}
+	}
+}
+
+// WithFit sets how images are placed into their cells.
+func WithFit(f Fit) Option {
+	return func(o *options) {
+		o.fit = f
+	}
+}
+
+// WithLayout sets how images are arranged. With LayoutJustified cols sets the width
+// of the collage and the number of rows follows from the aspect ratios of images.
+func WithLayout(l Layout) Option {
+	return func(o *options) {
+		o.layout = l
+	}
+}
+
+// WithBackground sets the color used to fill the canvas behind the cells.
+func WithBackground(c color.Color) Option {
+	return func(o *options) {
+		if c != nil {
+			o.background = c
+		}
+	}
+}
+
+// WithPadding sets the spacing in pixels between cells. If border is true
+// the same spacing is added around the outer edge of the grid.
+func WithPadding(padding int, border bool) Option {
+	return func(o *options) {
+		o.padding = max(0, padding)
+		o.border = border
+	}
+}
+
+// WithFormat sets the encoding of the resulting collage. PNG output keeps
+// transparency, so a transparent background is allowed.
+func WithFormat(f Format) Option {
+	return func(o *options) {
+		o.format = f
+	}
+}
+
+// WithQuality sets the JPEG quality in range [1, 100]. Out of range values are clamped.
+func WithQuality(q int) Option {
+	return func(o *options) {
+		o.quality = min(max(q, 1), 100)
+	}
+}
+
+// WithSkipInvalid makes Concat skip images that fail to decode instead of
+// failing the whole collage. The grid shrinks to fit the remaining images.
+func WithSkipInvalid(skip bool) Option {
+	return func(o *options) {
+		o.skipInvalid = skip
+	}
+}
+
+// WithConcurrency sets how many images are decoded in parallel.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = max(1, n)
+	}
+}
+
+// WithCenterLastRow horizontally centers images of the last row when it isn't full.
+func WithCenterLastRow(center bool) Option {
+	return func(o *options) {
+		o.centerLast = center
+	}
+}
+
+// WithMaxDimension limits the width and height of the resulting collage.
+// Larger collages are downscaled keeping the aspect ratio. Zero means no limit.
+func WithMaxDimension(px int) Option {
+	return func(o *options) {
+		o.maxDimension = max(0, px)
+	}
+}
+
+// WithCellSize scales every image to w by h cells instead of the size of the first image.
+// Zero sizes mean the size of the first image.
+func WithCellSize(w, h int) Option {
+	return func(o *options) {
+		if w > 0 && h > 0 {
+			o.cellWidth, o.cellHeight = w, h
+		}
+	}
+}
+
+// WithMaxSideSum limits the sum of the width and height of the resulting collage,
+// as Telegram does for photos. Larger collages are downscaled keeping the aspect ratio.
+// Zero means no limit.
+func WithMaxSideSum(px int) Option {
+	return func(o *options) {
+		o.maxSideSum = max(0, px)
+	}
+}
+
+// WithMaxAspectRatio limits how many times the longer side of the grid may exceed
+// the shorter one. A grid over the limit is laid out with another number of columns.
+// Zero means no limit.
+func WithMaxAspectRatio(ratio float64) Option {
+	return func(o *options) {
+		o.maxRatio = max(0, ratio)
+	}
+}
+
+// WithTitle adds a band with the title above the grid.
+func WithTitle(title string) Option {
+	return func(o *options) {
+		o.title = title
+	}
+}
+
+// WithFont renders the title with the font of the size in points instead of
+// the default bitmap face. Unless WithTitleHeight is set, the title band fits the font.
+func WithFont(f *opentype.Font, size float64) Option {
+	return func(o *options) {
+		if f != nil && size > 0 {
+			o.font, o.fontSize = f, size
+		}
+	}
+}
+
+// WithTitleHeight sets the height of the title band.
+func WithTitleHeight(px int) Option {
+	return func(o *options) {
+		if px > 0 {
+			o.titleHeight = px
+		}
+	}
+}
+
+// WithLabelCells draws the index of the source image in the corner of each cell.
+// It's meant for debugging layouts.
+func WithLabelCells(label bool) Option {
+	return func(o *options) {
+		o.labelCells = label
+	}
+}
+
+// WithCornerRadius rounds corners of each cell with the given radius.
+// The background is visible at the corners.
+func WithCornerRadius(px int) Option {
+	return func(o *options) {
+		o.cornerRadius = max(0, px)
+	}
+}
+
+// WithCellBorder draws a border of the given width and color around each cell.
+// The border is drawn outside of the image, so the cells grow by twice the width.
+func WithCellBorder(width int, c color.Color) Option {
+	return func(o *options) {
+		o.borderWidth = max(0, width)
+		if c != nil {
+			o.borderColor = c
+		}
+	}
+}
+
+// WithBlurFill fills the letterbox area of FitContain cells with a blurred
+// copy of the same image instead of the background color.
+func WithBlurFill(blur bool) Option {
+	return func(o *options) {
+		o.blurFill = blur
+	}
+}
+
+// WithProgressive encodes JPEG collages as progressive ones that clients render incrementally.
+// The standard library encodes baseline JPEGs only, so it fails with ErrNoProgressiveEncoder
+// unless an encoder is given with WithProgressiveEncoder.
+func WithProgressive(progressive bool) Option {
+	return func(o *options) {
+		o.progressive = progressive
+	}
+}
+
+// ProgressiveEncoder encodes a progressive JPEG with the quality in range [1, 100].
+type ProgressiveEncoder func(w io.Writer, img image.Image, quality int) error
+
+// WithProgressiveEncoder sets the encoder of progressive JPEGs used with WithProgressive.
+func WithProgressiveEncoder(e ProgressiveEncoder) Option {
+	return func(o *options) {
+		o.progressiveEncoder = e
+	}
+}
+
+var (
+	// ErrNoImages is returned when there are no images to make a collage of.
+	ErrNoImages = errors.New("no images")
+	// ErrGridTooSmall is returned when the grid has fewer cells than images.
+	ErrGridTooSmall = errors.New("grid is too small")
+	// ErrNoProgressiveEncoder is returned when a progressive JPEG is asked without an encoder.
+	ErrNoProgressiveEncoder = errors.New("no progressive JPEG encoder")
 )
 
-// ConcatImages concatenates images in a grid
-func concat(images []image.Image, rows, cols int) image.Image {
+// SkippedError is returned along with the collage when some images were skipped.
+type SkippedError struct {
+	// Indexes of the skipped images in the input.
+	Indexes []int
+	Err     error
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("skipped %d invalid images: %v", len(e.Indexes), e.Err)
+}
+
+func (e *SkippedError) Unwrap() error {
+	return e.Err
+}
+
+// concat concatenates images in a grid
+func concat(images []image.Image, rows, cols int, o options) draw.Image {
 	if len(images) == 0 {
 		return nil
 	}
 
-	// Assuming all images have the same size, get the dimensions of the first image
-	imgWidth := images[0].Bounds().Dx()
-	imgHeight := images[0].Bounds().Dy()
+	cells, size, _ := layout(images, rows, cols, o)
+	return render(images, cells, size, o)
+}
 
-	// Create a blank canvas for the final image
-	gridWidth := cols * imgWidth
-	gridHeight := rows * imgHeight
-	newImage := image.NewRGBA(image.Rect(0, 0, gridWidth, gridHeight))
+// layout returns the cell of each image, the size of the canvas and the number of rows.
+func layout(images []image.Image, rows, cols int, o options) ([]image.Rectangle, image.Point, int) {
+	margin := 0
+	if o.border {
+		margin = o.padding
+	}
 
-	// Fill the background with white color (optional)
-	draw.Draw(newImage, newImage.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	if o.layout == LayoutJustified {
+		width, _ := gridSize(images[0], 1, cols, o)
+		_, cellHeight := cellSize(images[0], o)
+		sizes := make([]image.Point, len(images))
+		for i, img := range images {
+			sizes[i] = img.Bounds().Size()
+		}
+
+		cells, rows, height := justifyRows(sizes, width-2*margin, cellHeight, o.padding, o.centerLast)
+		for i := range cells {
+			cells[i] = cells[i].Add(image.Pt(margin, margin))
+		}
+		return cells, image.Pt(width, height+2*margin), rows
+	}
+
+	// Every image is scaled to the same size, so the grid stays uniform
+	cellWidth, cellHeight := cellSize(images[0], o)
+
+	// Shift of the last incomplete row to center it
+	lastRow := (len(images) - 1) / cols
+	lastRowShift := 0
+	if o.centerLast {
+		empty := cols - (len(images) - lastRow*cols)
+		lastRowShift = empty * (cellWidth + o.padding) / 2
+	}
+
+	cells := make([]image.Rectangle, len(images))
+	for idx := range images {
+		xOffset := margin + (idx%cols)*(cellWidth+o.padding)
+		if idx/cols == lastRow {
+			xOffset += lastRowShift
+		}
+		yOffset := margin + (idx/cols)*(cellHeight+o.padding)
+		cells[idx] = image.Rect(xOffset, yOffset, xOffset+cellWidth, yOffset+cellHeight)
+	}
+
+	gridWidth, gridHeight := gridSize(images[0], rows, cols, o)
+	return cells, image.Pt(gridWidth, gridHeight), rows
+}
+
+// justifyRows packs images of the sizes into rows of the width keeping their aspect ratios.
+// Images are added to a row at the height until the row is as wide as the width,
+// then the row is scaled to fill the width exactly. The last row that isn't full keeps
+// the height. It returns the cells, the number of rows and the total height.
+func justifyRows(sizes []image.Point, width, height, padding int, centerLast bool) ([]image.Rectangle, int, int) {
+	widthAt := func(size image.Point, h float64) float64 {
+		return float64(size.X) * h / float64(max(1, size.Y))
+	}
+
+	var (
+		cells []image.Rectangle
+		rows  int
+		y     int
+	)
+	for start := 0; start < len(sizes); rows++ {
+		end := start
+		sum := 0.0
+		for end < len(sizes) {
+			sum += widthAt(sizes[end], float64(height))
+			end++
+			if sum+float64((end-start-1)*padding) >= float64(width) {
+				break
+			}
+		}
+
+		gaps := (end - start - 1) * padding
+		full := sum+float64(gaps) >= float64(width)
+		scale := 1.0
+		if full {
+			scale = float64(max(1, width-gaps)) / sum
+		}
+		rowHeight := max(1, int(math.Round(float64(height)*scale)))
+
+		shift := 0
+		if !full && centerLast {
+			shift = (width - int(math.Round(sum)) - gaps) / 2
+		}
+
+		// cells are placed at rounded running sums, so the rounding errors don't add up
+		x := 0.0
+		for i := start; i < end; i++ {
+			x0 := shift + int(math.Round(x)) + (i-start)*padding
+			x += widthAt(sizes[i], float64(height)) * scale
+			x1 := shift + int(math.Round(x)) + (i-start)*padding
+			if full && i == end-1 {
+				x1 = width
+			}
+			cells = append(cells, image.Rect(x0, y, max(x1, x0+1), y+rowHeight))
+		}
+
+		y += rowHeight + padding
+		start = end
+	}
+
+	return cells, rows, y - padding
+}
+
+// render draws every image into its cell on a canvas of the size.
+func render(images []image.Image, cells []image.Rectangle, size image.Point, o options) draw.Image {
+	newImage := newCanvas(image.Rectangle{Max: size}, o.format)
+
+	// Fill the background, it stays visible around letterboxed cells and in empty ones
+	draw.Draw(newImage, newImage.Bounds(), &image.Uniform{o.background}, image.Point{}, draw.Src)
 
 	// Draw each image in its respective place on the grid
 	for idx, img := range images {
-		xOffset := (idx % cols) * imgWidth
-		yOffset := (idx / cols) * imgHeight
-		r := image.Rect(xOffset, yOffset, xOffset+imgWidth, yOffset+imgHeight)
-		draw.Draw(newImage, r, img, image.Point{}, draw.Src)
+		cell := cells[idx]
+		if o.borderWidth > 0 {
+			drawFrame(newImage, cell, o.borderWidth, o.borderColor)
+			cell = cell.Inset(o.borderWidth)
+		}
+
+		r, sr := cell, img.Bounds()
+		switch o.fit {
+		case FitContain:
+			r = containRect(sr, r)
+			if o.blurFill && r != cell {
+				drawBlurFill(newImage, cell, img)
+			}
+		case FitCrop:
+			sr = cropRect(sr, r)
+		}
+		drawCell(newImage, r, img, sr, o)
+
+		if o.labelCells {
+			drawLabel(newImage, cell, strconv.Itoa(idx))
+		}
+	}
+
+	return downscale(addTitle(newImage, o), o)
+}
+
+// imageSize is the size images are scaled to, the size of the first one unless WithCellSize is set.
+func imageSize(first image.Image, o options) (w, h int) {
+	if o.cellWidth > 0 && o.cellHeight > 0 {
+		return o.cellWidth, o.cellHeight
 	}
 
-	return newImage
+	return first.Bounds().Dx(), first.Bounds().Dy()
+}
+
+// cellSize is the size of grid cells, including the border drawn around images.
+func cellSize(first image.Image, o options) (w, h int) {
+	w, h = imageSize(first, o)
+	return w + 2*o.borderWidth, h + 2*o.borderWidth
+}
+
+// gridSize is the size of the grid of rows by cols cells without the title.
+func gridSize(first image.Image, rows, cols int, o options) (w, h int) {
+	cellWidth, cellHeight := cellSize(first, o)
+
+	margin := 0
+	if o.border {
+		margin = o.padding
+	}
+
+	return cols*cellWidth + (cols-1)*o.padding + 2*margin, rows*cellHeight + (rows-1)*o.padding + 2*margin
+}
+
+// fitRatio returns the grid for n images closest to rows by cols
+// which aspect ratio doesn't exceed the max one.
+func fitRatio(first image.Image, n, rows, cols int, o options) (int, int) {
+	ratio := func(cols int) float64 {
+		w, h := gridSize(first, (n+cols-1)/cols, cols, o)
+		return float64(max(w, h)) / float64(max(1, min(w, h)))
+	}
+	if o.maxRatio == 0 || n == 0 || ratio(cols) <= o.maxRatio {
+		return rows, cols
+	}
+
+	// a too tall grid gets wider and a too wide one gets narrower
+	w, h := gridSize(first, rows, cols, o)
+	step := 1
+	if w > h {
+		step = -1
+	}
+	for c := cols + step; c >= 1 && c <= n; c += step {
+		if ratio(c) <= o.maxRatio {
+			return (n + c - 1) / c, c
+		}
+	}
+
+	return rows, cols
+}
+
+// drawCell draws the sr part of the image scaled to r.
+func drawCell(dst draw.Image, r image.Rectangle, img image.Image, sr image.Rectangle, o options) {
+	if o.cornerRadius > 0 {
+		// scale into a temporary image to draw it through the rounded mask
+		scaled := image.NewRGBA(r)
+		drawCell(scaled, r, img, sr, options{interpolator: o.interpolator})
+		draw.DrawMask(dst, r, scaled, r.Min, roundedRect{r: r, radius: o.cornerRadius}, r.Min, draw.Over)
+		return
+	}
+
+	if sr.Dx() == r.Dx() && sr.Dy() == r.Dy() {
+		draw.Draw(dst, r, img, sr.Min, draw.Src)
+		return
+	}
+
+	o.interpolator.Scale(dst, r, img, sr, draw.Src, nil)
+}
+
+// drawFrame draws a frame of the given width along the inner edge of r.
+func drawFrame(dst draw.Image, r image.Rectangle, width int, c color.Color) {
+	src := &image.Uniform{c}
+	sides := []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+width),
+		image.Rect(r.Min.X, r.Max.Y-width, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+width, r.Max.Y),
+		image.Rect(r.Max.X-width, r.Min.Y, r.Max.X, r.Max.Y),
+	}
+	for _, side := range sides {
+		draw.Draw(dst, side.Intersect(r), src, image.Point{}, draw.Src)
+	}
+}
+
+// roundedRect is an alpha mask of a rectangle with rounded corners.
+type roundedRect struct {
+	r      image.Rectangle
+	radius int
+}
+
+func (m roundedRect) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (m roundedRect) Bounds() image.Rectangle {
+	return m.r
+}
+
+func (m roundedRect) At(x, y int) color.Color {
+	if !image.Pt(x, y).In(m.r) {
+		return color.Transparent
+	}
+
+	radius := min(m.radius, m.r.Dx()/2, m.r.Dy()/2)
+
+	// distance from the center of the nearest corner circle, if the point is in a corner
+	var dx, dy int
+	switch {
+	case x < m.r.Min.X+radius:
+		dx = m.r.Min.X + radius - x
+	case x >= m.r.Max.X-radius:
+		dx = x - (m.r.Max.X - radius - 1)
+	}
+	switch {
+	case y < m.r.Min.Y+radius:
+		dy = m.r.Min.Y + radius - y
+	case y >= m.r.Max.Y-radius:
+		dy = y - (m.r.Max.Y - radius - 1)
+	}
+
+	if dx > 0 && dy > 0 && dx*dx+dy*dy > radius*radius {
+		return color.Transparent
+	}
+
+	return color.Opaque
+}
+
+// downscale shrinks the image so none of its sides exceeds the max dimension
+// and the sum of the sides doesn't exceed the max side sum.
+func downscale(img draw.Image, o options) draw.Image {
+	w, h := downscaledSize(img.Bounds().Dx(), img.Bounds().Dy(), o)
+	if w == img.Bounds().Dx() && h == img.Bounds().Dy() {
+		return img
+	}
+
+	dst := newCanvas(image.Rect(0, 0, w, h), o.format)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// downscaledSize returns the size downscale shrinks an image of w by h to.
+func downscaledSize(w, h int, o options) (int, int) {
+	scale := 1.0
+	if o.maxDimension > 0 && max(w, h) > o.maxDimension {
+		scale = float64(o.maxDimension) / float64(max(w, h))
+	}
+	if o.maxSideSum > 0 && w+h > o.maxSideSum {
+		scale = min(scale, float64(o.maxSideSum)/float64(w+h))
+	}
+	if scale == 1 {
+		return w, h
+	}
+
+	return max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+}
+
+func newCanvas(r image.Rectangle, f Format) draw.Image {
+	if f == FormatPNG {
+		return image.NewNRGBA(r)
+	}
+
+	return image.NewRGBA(r)
+}
+
+// containRect returns the largest rectangle with the aspect ratio of src
+// that fits into cell, centered inside it.
+func containRect(src, cell image.Rectangle) image.Rectangle {
+	w, h := cell.Dx(), cell.Dy()
+	if src.Dx()*cell.Dy() > src.Dy()*cell.Dx() {
+		h = max(1, src.Dy()*cell.Dx()/src.Dx())
+	} else {
+		w = max(1, src.Dx()*cell.Dy()/src.Dy())
+	}
+
+	x := cell.Min.X + (cell.Dx()-w)/2
+	y := cell.Min.Y + (cell.Dy()-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// cropRect returns the largest centered part of src with the aspect ratio of cell.
+func cropRect(src, cell image.Rectangle) image.Rectangle {
+	w, h := src.Dx(), src.Dy()
+	if src.Dx()*cell.Dy() > src.Dy()*cell.Dx() {
+		w = max(1, src.Dy()*cell.Dx()/cell.Dy())
+	} else {
+		h = max(1, src.Dx()*cell.Dy()/cell.Dx())
+	}
+
+	x := src.Min.X + (src.Dx()-w)/2
+	y := src.Min.Y + (src.Dy()-h)/2
+	return image.Rect(x, y, x+w, y+h)
 }
 
 func decode(b []byte) (image.Image, error) {
+	if bytes.HasPrefix(b, []byte("GIF8")) {
+		return decodeGIF(b)
+	}
+
 	img, _, err := image.Decode(bytes.NewReader(b))
 	if err != nil {
 		return nil, fmt.Errorf("decode image: %w", err)
 	}
 
-	return img, nil
+	return orient(img, orientation(b)), nil
+}
+
+// Dimensions returns the size of the encoded image reading only its header.
+// The size respects the EXIF orientation like the decoded image does.
+func Dimensions(b []byte) (w, h int, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return 0, 0, fmt.Errorf("decode image config: %w", err)
+	}
+
+	// orientations from 5 to 8 rotate the image by 90 degrees
+	if orientation(b) >= 5 {
+		return cfg.Height, cfg.Width, nil
+	}
+
+	return cfg.Width, cfg.Height, nil
+}
+
+// decodeGIF returns the first frame of a possibly animated GIF as an RGBA image.
+func decodeGIF(b []byte) (image.Image, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("decode gif: %w", err)
+	}
+	if len(g.Image) == 0 {
+		return nil, errors.New("decode gif: no frames")
+	}
+
+	// a frame may cover only a part of the logical screen
+	r := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if r.Empty() {
+		r = g.Image[0].Bounds()
+	}
+
+	frame := image.NewRGBA(r)
+	draw.Draw(frame, g.Image[0].Bounds(), g.Image[0], g.Image[0].Bounds().Min, draw.Src)
+	return frame, nil
+}
+
+// toRGBA converts the image to RGBA, so cells are drawn the same fast way
+// whatever the color model of the source is.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+func encode(w io.Writer, i image.Image, o options) error {
+	var err error
+	switch {
+	case o.format == FormatPNG:
+		err = png.Encode(w, i)
+	case o.progressive && o.progressiveEncoder == nil:
+		err = ErrNoProgressiveEncoder
+	case o.progressive:
+		err = o.progressiveEncoder(w, i, o.quality)
+	default:
+		err = jpeg.Encode(w, i, &jpeg.Options{Quality: o.quality})
+	}
+	if err != nil {
+		return fmt.Errorf("encode image: %w", err)
+	}
+
+	return nil
+}
+
+// GridFor returns the most square grid that fits n images.
+func GridFor(n int) (rows, cols int) {
+	if n <= 0 {
+		return 0, 0
+	}
+
+	cols = int(math.Ceil(math.Sqrt(float64(n))))
+	rows = (n + cols - 1) / cols
+	return rows, cols
+}
+
+// ConcatResult describes a built collage.
+type ConcatResult struct {
+	// Width and Height of the whole collage.
+	Width, Height int
+	// CellWidth and CellHeight are the size of an image cell before downscaling.
+	CellWidth, CellHeight int
+	Rows, Cols            int
+	// Images is the number of placed images.
+	Images int
+	// Relaid is true if the grid differs from the asked one to fit WithMaxAspectRatio.
+	Relaid bool
+}
+
+// Concat decodes images and draws them in a grid of rows by cols.
+// If both rows and cols are zero the grid is chosen by GridFor.
+// With WithSkipInvalid the collage is returned together with a *SkippedError
+// if any of the images couldn't be decoded.
+func Concat(images [][]byte, rows, cols int, opts ...Option) ([]byte, error) {
+	collage, _, err := ConcatWithResult(images, rows, cols, opts...)
+	return collage, err
 }
 
-func encode(i image.Image) ([]byte, error) {
+// ConcatWithResult works like Concat and also describes the built collage.
+func ConcatWithResult(images [][]byte, rows, cols int, opts ...Option) ([]byte, ConcatResult, error) {
 	w := &bytes.Buffer{}
-	err := jpeg.Encode(w, i, &jpeg.Options{Quality: 100})
+
+	res, err := concatTo(images, rows, cols, w, newOptions(opts))
+	var skipped *SkippedError
+	if err != nil && !errors.As(err, &skipped) {
+		return nil, ConcatResult{}, err
+	}
+
+	return w.Bytes(), res, err
+}
+
+// ConcatTo works like Concat but encodes the collage directly into w.
+func ConcatTo(images [][]byte, rows, cols int, w io.Writer, opts ...Option) error {
+	_, err := concatTo(images, rows, cols, w, newOptions(opts))
+	return err
+}
+
+func concatTo(images [][]byte, rows, cols int, w io.Writer, o options) (ConcatResult, error) {
+	collage, res, skipped, err := build(images, rows, cols, o)
 	if err != nil {
-		return nil, fmt.Errorf("encode image: %w", err)
+		return ConcatResult{}, err
 	}
 
-	return w.Bytes(), nil
+	err = encode(w, collage, o)
+	if err != nil {
+		return ConcatResult{}, err
+	}
+	if skipped != nil {
+		return res, skipped
+	}
+
+	return res, nil
+}
+
+// ConcatPaged splits images into pages of at most perPage images and makes
+// a collage of each page. All pages share the grid width chosen for a full page.
+// Skipped images of all pages are reported in a single *SkippedError.
+func ConcatPaged(images [][]byte, perPage int, opts ...Option) ([][]byte, error) {
+	if perPage <= 0 {
+		return nil, fmt.Errorf("invalid page size %d", perPage)
+	}
+
+	_, cols := GridFor(perPage)
+
+	var (
+		pages   [][]byte
+		skipped *SkippedError
+		offset  int
+	)
+	for chunk := range slices.Chunk(images, perPage) {
+		pageCols := min(cols, len(chunk))
+		pageRows := (len(chunk) + pageCols - 1) / pageCols
+
+		page, err := Concat(chunk, pageRows, pageCols, opts...)
+		var pageSkipped *SkippedError
+		if errors.As(err, &pageSkipped) {
+			if skipped == nil {
+				skipped = &SkippedError{}
+			}
+			for _, i := range pageSkipped.Indexes {
+				skipped.Indexes = append(skipped.Indexes, offset+i)
+			}
+			skipped.Err = errors.Join(skipped.Err, pageSkipped.Err)
+		} else if err != nil {
+			return nil, fmt.Errorf("page %d: %w", len(pages)+1, err)
+		}
+
+		pages = append(pages, page)
+		offset += len(chunk)
+	}
+
+	if skipped != nil {
+		return pages, skipped
+	}
+
+	return pages, nil
 }
 
-func Concat(images [][]byte, rows, cols int) ([]byte, error) {
-	imgs := make([]image.Image, len(images))
+func build(images [][]byte, rows, cols int, o options) (draw.Image, ConcatResult, *SkippedError, error) {
+	if len(images) == 0 {
+		return nil, ConcatResult{}, nil, fmt.Errorf("concat images: %w", ErrNoImages)
+	}
+
+	imgs, skipped := decodeAll(images, o)
+	if skipped != nil && (!o.skipInvalid || len(imgs) == 0) {
+		return nil, ConcatResult{}, nil, fmt.Errorf("concat images: %w", skipped.Err)
+	}
+
+	switch {
+	case rows == 0 && cols == 0:
+		rows, cols = GridFor(len(images))
+	case o.layout == LayoutJustified:
+		// rows follow from the images
+		rows = (len(images) + max(1, cols) - 1) / max(1, cols)
+	}
+	// the grid must hold all the images, skipped ones don't make a small grid valid
+	if rows <= 0 || cols <= 0 || rows*cols < len(images) {
+		return nil, ConcatResult{}, nil, fmt.Errorf("concat images: %w: %d rows and %d cols can't hold %d images", ErrGridTooSmall, rows, cols, len(images))
+	}
+	if skipped != nil {
+		// the grid shrinks to the remaining images
+		cols = min(cols, len(imgs))
+		rows = (len(imgs) + cols - 1) / cols
+	}
+
+	relaid := false
+	if o.layout == LayoutGrid {
+		r, c := fitRatio(imgs[0], len(imgs), rows, cols, o)
+		relaid = r != rows || c != cols
+		rows, cols = r, c
+	}
+
+	cells, size, rows := layout(imgs, rows, cols, o)
+	collage := render(imgs, cells, size, o)
+
+	cellWidth, cellHeight := imageSize(imgs[0], o)
+	res := ConcatResult{
+		Width:      collage.Bounds().Dx(),
+		Height:     collage.Bounds().Dy(),
+		CellWidth:  cellWidth,
+		CellHeight: cellHeight,
+		Rows:       rows,
+		Cols:       cols,
+		Images:     len(imgs),
+		Relaid:     relaid,
+	}
+
+	return collage, res, skipped, nil
+}
+
+// decodeAll decodes images keeping the input order. Images that fail to decode
+// are left out of the result and reported in the returned error.
+func decodeAll(images [][]byte, o options) ([]image.Image, *SkippedError) {
+	decoded := make([]image.Image, len(images))
+	errs := make([]error, len(images))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(o.concurrency, len(images)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				decoded[i], errs[i] = decode(images[i])
+				if errs[i] == nil {
+					decoded[i] = toRGBA(decoded[i])
+				}
+			}
+		}()
+	}
 	for i := range images {
-		img, err := decode(images[i])
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var skipped *SkippedError
+	imgs := make([]image.Image, 0, len(images))
+	for i, err := range errs {
 		if err != nil {
-			return nil, fmt.Errorf("concat images: %w", err)
+			if skipped == nil {
+				skipped = &SkippedError{}
+			}
+			skipped.Indexes = append(skipped.Indexes, i)
+			skipped.Err = errors.Join(skipped.Err, err)
+			// the first error by input order, no matter which one was decoded first
+			if !o.skipInvalid {
+				return nil, skipped
+			}
+			continue
 		}
-		imgs[i] = img
+		imgs = append(imgs, decoded[i])
 	}
 
-	collage := concat(imgs, rows, cols)
-	return encode(collage)
+	return imgs, skipped
 }
@@ -0,0 +1,809 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/image/draw"
+)
+
+func TestConcatResizesToFirstImage(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{
+		newJPEG(is, 100, 100, color.RGBA{R: 255, A: 255}),
+		newJPEG(is, 200, 50, color.RGBA{G: 255, A: 255}),
+		newJPEG(is, 50, 200, color.RGBA{B: 255, A: 255}),
+	}
+
+	for _, interpolator := range []draw.Interpolator{nil, draw.NearestNeighbor, draw.CatmullRom} {
+		collage, err := Concat(images, 2, 2, WithInterpolator(interpolator))
+		is.NoErr(err)
+
+		img, _, err := image.Decode(bytes.NewReader(collage))
+		is.NoErr(err)
+		is.Equal(2*100, img.Bounds().Dx())
+		is.Equal(2*100, img.Bounds().Dy())
+
+		// scaled cells must cover the whole cell without black borders
+		for _, p := range []image.Point{{100, 0}, {199, 99}, {0, 100}, {99, 199}} {
+			r, g, b, _ := img.At(p.X, p.Y).RGBA()
+			is.True(r>>8+g>>8+b>>8 > 128)
+		}
+	}
+}
+
+func TestConcatFitContain(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	green := color.RGBA{G: 255, A: 255}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	images := []image.Image{
+		newImage(100, 100, red),
+		newImage(200, 100, blue),
+		newImage(50, 100, green),
+	}
+
+	collage := concat(images, 1, 3, newOptions([]Option{WithFit(FitContain)}))
+	is.Equal(image.Rect(0, 0, 300, 100), collage.Bounds())
+
+	// 2:1 image is scaled to 100x50 and centered vertically
+	is.Equal(white, collage.At(150, 24))
+	is.Equal(blue, collage.At(100, 25))
+	is.Equal(blue, collage.At(199, 74))
+	is.Equal(white, collage.At(150, 75))
+
+	// 1:2 image is scaled to 50x100 and centered horizontally
+	is.Equal(white, collage.At(224, 50))
+	is.Equal(green, collage.At(225, 0))
+	is.Equal(green, collage.At(274, 99))
+	is.Equal(white, collage.At(275, 50))
+
+	// stretch stays the default
+	collage = concat(images, 1, 3, newOptions(nil))
+	is.Equal(blue, collage.At(150, 0))
+	is.Equal(green, collage.At(200, 50))
+}
+
+func TestConcatBackground(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	images := []image.Image{newImage(100, 100, red), newImage(100, 50, red)}
+
+	collage := concat(images, 2, 2, newOptions(nil))
+	is.Equal(color.RGBA{R: 255, G: 255, B: 255, A: 255}, collage.At(150, 150))
+
+	black := color.RGBA{A: 255}
+	collage = concat(images, 2, 2, newOptions([]Option{WithBackground(black), WithFit(FitContain)}))
+	is.Equal(black, collage.At(150, 10))
+	is.Equal(black, collage.At(150, 150))
+}
+
+func TestConcatPadding(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	black := color.RGBA{A: 255}
+	images := []image.Image{newImage(100, 100, red), newImage(100, 100, red), newImage(100, 100, red)}
+
+	collage := concat(images, 2, 2, newOptions([]Option{WithPadding(10, true), WithBackground(black)}))
+	is.Equal(image.Rect(0, 0, 2*100+3*10, 2*100+3*10), collage.Bounds())
+	is.Equal(black, collage.At(5, 5))     // outer border
+	is.Equal(red, collage.At(10, 10))     // first cell
+	is.Equal(black, collage.At(115, 50))  // between first and second cells
+	is.Equal(red, collage.At(120, 10))    // second cell
+	is.Equal(black, collage.At(50, 115))  // between rows
+	is.Equal(red, collage.At(10, 120))    // third cell
+	is.Equal(black, collage.At(224, 224)) // outer border
+
+	collage = concat(images, 2, 2, newOptions([]Option{WithPadding(10, false), WithBackground(black)}))
+	is.Equal(image.Rect(0, 0, 2*100+10, 2*100+10), collage.Bounds())
+	is.Equal(red, collage.At(0, 0))
+	is.Equal(black, collage.At(105, 50))
+	is.Equal(red, collage.At(110, 0))
+}
+
+func TestConcatFormat(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{newJPEG(is, 100, 100, color.RGBA{R: 255, A: 255})}
+
+	collage, err := Concat(images, 1, 2)
+	is.NoErr(err)
+	_, format, err := image.DecodeConfig(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal("jpeg", format)
+
+	collage, err = Concat(images, 1, 2, WithFormat(FormatPNG), WithBackground(color.Transparent))
+	is.NoErr(err)
+	_, format, err = image.DecodeConfig(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal("png", format)
+
+	img, err := png.Decode(bytes.NewReader(collage))
+	is.NoErr(err)
+	_, _, _, a := img.At(150, 50).RGBA()
+	is.Equal(uint32(0), a) // empty cell stays transparent
+}
+
+func TestConcatQuality(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{
+		newJPEG(is, 100, 100, color.RGBA{R: 255, A: 255}),
+		newJPEG(is, 100, 100, color.RGBA{G: 255, A: 255}),
+		newJPEG(is, 100, 100, color.RGBA{B: 255, A: 255}),
+	}
+
+	low, err := Concat(images, 2, 2, WithQuality(10))
+	is.NoErr(err)
+	high, err := Concat(images, 2, 2, WithQuality(95))
+	is.NoErr(err)
+	is.True(len(low) < len(high))
+}
+
+func TestConcatSkipInvalid(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{
+		newPNG(is, 100, 100, color.RGBA{R: 255, A: 255}),
+		[]byte("garbage"),
+		newPNG(is, 100, 100, color.RGBA{B: 255, A: 255}),
+	}
+
+	_, err := Concat(images, 1, 3)
+	is.True(err != nil)
+
+	collage, err := Concat(images, 1, 3, WithSkipInvalid(true))
+	var skipped *SkippedError
+	is.True(errors.As(err, &skipped))
+	is.Equal([]int{1}, skipped.Indexes)
+
+	img, _, err := image.Decode(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal(image.Pt(200, 100), img.Bounds().Size()) // grid shrinks to the valid images
+
+	_, err = Concat([][]byte{[]byte("garbage")}, 1, 1, WithSkipInvalid(true))
+	is.True(err != nil)
+	is.True(!errors.As(err, &skipped))
+
+	// invalid grids are refused before shrinking
+	_, err = Concat(images, 2, 0, WithSkipInvalid(true))
+	is.True(errors.Is(err, ErrGridTooSmall))
+	_, err = Concat(images, 1, 2, WithSkipInvalid(true))
+	is.True(errors.Is(err, ErrGridTooSmall))
+}
+
+func TestDecodeAllKeepsOrder(t *testing.T) {
+	is := is.New(t)
+
+	var images [][]byte
+	for i := range 20 {
+		images = append(images, newPNG(is, 10+i, 10, color.White))
+	}
+
+	imgs, skipped := decodeAll(images, newOptions([]Option{WithConcurrency(4)}))
+	is.True(skipped == nil)
+	for i, img := range imgs {
+		is.Equal(10+i, img.Bounds().Dx())
+	}
+
+	images[5], images[15] = []byte("garbage"), []byte("garbage")
+	for range 10 {
+		_, skipped = decodeAll(images, newOptions([]Option{WithConcurrency(8)}))
+		is.Equal([]int{5}, skipped.Indexes)
+	}
+}
+
+func BenchmarkDecodeAll(b *testing.B) {
+	is := is.New(b)
+
+	images := make([][]byte, 40)
+	for i := range images {
+		images[i] = newJPEG(is, 640, 480, color.RGBA{R: uint8(i), G: 128, B: 255, A: 255})
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		o := newOptions([]Option{WithConcurrency(1)})
+		for range b.N {
+			decodeAll(images, o)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		o := newOptions(nil)
+		for range b.N {
+			decodeAll(images, o)
+		}
+	})
+}
+
+func TestDecodeAllConvertsToRGBA(t *testing.T) {
+	is := is.New(t)
+
+	gifBuf := &bytes.Buffer{}
+	is.NoErr(gif.Encode(gifBuf, newImage(8, 8, color.White), nil))
+
+	imgs, skipped := decodeAll([][]byte{newJPEG(is, 8, 8, color.White), gifBuf.Bytes()}, newOptions(nil))
+	is.True(skipped == nil)
+	for _, img := range imgs {
+		_, ok := img.(*image.RGBA)
+		is.True(ok)
+	}
+}
+
+func BenchmarkConcatColorModel(b *testing.B) {
+	is := is.New(b)
+
+	images := make([]image.Image, 25)
+	for i := range images {
+		img, err := decode(newJPEG(is, 640, 480, color.RGBA{R: uint8(i), G: 128, B: 255, A: 255}))
+		is.NoErr(err)
+		images[i] = img
+	}
+	converted := make([]image.Image, len(images))
+	for i, img := range images {
+		converted[i] = toRGBA(img)
+	}
+
+	o := newOptions(nil)
+	b.Run("direct", func(b *testing.B) {
+		for range b.N {
+			concat(images, 5, 5, o)
+		}
+	})
+	b.Run("converted", func(b *testing.B) {
+		for range b.N {
+			concat(converted, 5, 5, o)
+		}
+	})
+}
+
+func TestGridFor(t *testing.T) {
+	is := is.New(t)
+
+	tests := []struct {
+		n, rows, cols int
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{4, 2, 2},
+		{7, 3, 3},
+		{10, 3, 4},
+		{25, 5, 5},
+	}
+	for _, tt := range tests {
+		rows, cols := GridFor(tt.n)
+		is.Equal(tt.rows, rows)
+		is.Equal(tt.cols, cols)
+		is.True(rows*cols >= tt.n)
+		is.True(cols-rows <= 1)
+	}
+}
+
+func TestConcatAutoGrid(t *testing.T) {
+	is := is.New(t)
+
+	var images [][]byte
+	for range 7 {
+		images = append(images, newPNG(is, 10, 10, color.White))
+	}
+
+	collage, err := Concat(images, 0, 0)
+	is.NoErr(err)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal(30, cfg.Width)
+	is.Equal(30, cfg.Height)
+}
+
+func TestConcatCenterLastRow(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	var images []image.Image
+	for range 7 {
+		images = append(images, newImage(10, 10, red))
+	}
+
+	collage := concat(images, 3, 3, newOptions(nil))
+	is.Equal(red, collage.At(0, 20))
+	is.Equal(white, collage.At(10, 20))
+
+	// the last image is moved to the middle column
+	collage = concat(images, 3, 3, newOptions([]Option{WithCenterLastRow(true)}))
+	is.Equal(white, collage.At(9, 20))
+	is.Equal(red, collage.At(10, 20))
+	is.Equal(red, collage.At(19, 29))
+	is.Equal(white, collage.At(20, 20))
+
+	// half of the empty space with padding
+	images = images[:5]
+	collage = concat(images, 2, 3, newOptions([]Option{WithCenterLastRow(true), WithPadding(2, false)}))
+	is.Equal(white, collage.At(5, 12))
+	is.Equal(red, collage.At(6, 12))
+	is.Equal(red, collage.At(27, 12))
+	is.Equal(white, collage.At(28, 12))
+}
+
+func TestJustifyRows(t *testing.T) {
+	is := is.New(t)
+
+	sizes := []image.Point{
+		{400, 300}, {300, 400}, {1000, 300}, {300, 300},
+		{200, 600}, {640, 480}, {500, 250}, {300, 400},
+		{800, 200},
+	}
+	const width, height, padding = 900, 200, 6
+
+	cells, rows, total := justifyRows(sizes, width, height, padding, false)
+	is.Equal(len(sizes), len(cells))
+
+	var byRow [][]image.Rectangle
+	for i, c := range cells {
+		if i == 0 || c.Min.Y != cells[i-1].Min.Y {
+			byRow = append(byRow, nil)
+		}
+		byRow[len(byRow)-1] = append(byRow[len(byRow)-1], c)
+	}
+	is.Equal(rows, len(byRow))
+	is.True(rows > 1)
+	is.Equal(total, byRow[rows-1][0].Max.Y)
+
+	for i, row := range byRow {
+		rowWidth := 0
+		for _, c := range row {
+			is.Equal(row[0].Dy(), c.Dy()) // cells of a row are equally high
+			rowWidth += c.Dx()
+		}
+		rowWidth += (len(row) - 1) * padding
+
+		if i < rows-1 {
+			is.True(rowWidth >= width-1 && rowWidth <= width) // full rows fill the width
+			is.Equal(width, row[len(row)-1].Max.X)
+		} else {
+			is.True(rowWidth <= width)
+		}
+	}
+
+	// aspect ratios are kept within rounding
+	for i, c := range cells {
+		want := float64(sizes[i].X) / float64(sizes[i].Y)
+		got := float64(c.Dx()) / float64(c.Dy())
+		is.True(math.Abs(want-got)*float64(c.Dy()) <= 2)
+	}
+}
+
+func TestConcatJustified(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{
+		newPNG(is, 100, 100, color.White),
+		newPNG(is, 200, 100, color.White),
+		newPNG(is, 50, 100, color.White),
+		newPNG(is, 100, 200, color.White),
+		newPNG(is, 300, 100, color.White),
+	}
+
+	collage, res, err := ConcatWithResult(images, 0, 3, WithLayout(LayoutJustified), WithPadding(4, true))
+	is.NoErr(err)
+	is.Equal(316, res.Width) // three cells of the first image with padding
+	is.Equal(2, res.Rows)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal(res.Width, cfg.Width)
+	is.Equal(res.Height, cfg.Height)
+}
+
+func TestConcatMaxDimension(t *testing.T) {
+	is := is.New(t)
+
+	var images []image.Image
+	for range 30 {
+		images = append(images, newImage(200, 300, color.White))
+	}
+
+	collage := concat(images, 5, 6, newOptions(nil))
+	is.Equal(image.Pt(1200, 1500), collage.Bounds().Size())
+
+	collage = concat(images, 5, 6, newOptions([]Option{WithMaxDimension(500)}))
+	is.Equal(image.Pt(400, 500), collage.Bounds().Size())
+
+	collage = concat(images, 5, 6, newOptions([]Option{WithMaxDimension(2000)}))
+	is.Equal(image.Pt(1200, 1500), collage.Bounds().Size())
+}
+
+func TestConcatCellSize(t *testing.T) {
+	is := is.New(t)
+
+	images := []image.Image{
+		newImage(100, 100, color.White),
+		newImage(640, 480, color.White),
+		newImage(30, 90, color.White),
+		newImage(1000, 1000, color.White),
+		newImage(50, 50, color.White),
+		newImage(300, 200, color.White),
+	}
+
+	collage := concat(images, 2, 3, newOptions([]Option{WithCellSize(256, 256)}))
+	is.Equal(image.Pt(3*256, 2*256), collage.Bounds().Size())
+
+	// falls back to the first image
+	collage = concat(images, 2, 3, newOptions([]Option{WithCellSize(0, 256)}))
+	is.Equal(image.Pt(300, 200), collage.Bounds().Size())
+}
+
+func TestConcatMaxSideSum(t *testing.T) {
+	is := is.New(t)
+
+	images := []image.Image{newImage(200, 300, color.White), newImage(200, 300, color.White)}
+
+	collage := concat(images, 1, 2, newOptions([]Option{WithMaxSideSum(350)}))
+	is.Equal(image.Pt(200, 150), collage.Bounds().Size())
+}
+
+func TestConcatMaxAspectRatio(t *testing.T) {
+	is := is.New(t)
+
+	images := make([][]byte, 50)
+	for i := range images {
+		images[i] = newJPEG(is, 10, 10, color.White)
+	}
+
+	// a tall strip gets wider
+	b, res, err := ConcatWithResult(images, 50, 1, WithMaxAspectRatio(20))
+	is.NoErr(err)
+	is.True(res.Relaid)
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+	is.NoErr(err)
+	is.True(float64(cfg.Height)/float64(cfg.Width) <= 20)
+	is.Equal(res.Cols*10, cfg.Width)
+
+	// a wide strip gets narrower
+	_, res, err = ConcatWithResult(images, 1, 50, WithMaxAspectRatio(20))
+	is.NoErr(err)
+	is.True(res.Relaid)
+	is.True(float64(res.Width)/float64(res.Height) <= 20)
+
+	_, res, err = ConcatWithResult(images[:5], 1, 5, WithMaxAspectRatio(20))
+	is.NoErr(err)
+	is.True(!res.Relaid)
+	is.Equal(5, res.Cols)
+}
+
+func TestConcatNoImages(t *testing.T) {
+	is := is.New(t)
+
+	_, err := Concat(nil, 0, 0)
+	is.True(errors.Is(err, ErrNoImages))
+
+	err = ConcatTo([][]byte{}, 1, 1, io.Discard)
+	is.True(errors.Is(err, ErrNoImages))
+}
+
+func TestConcatGridTooSmall(t *testing.T) {
+	is := is.New(t)
+
+	images := make([][]byte, 10)
+	for i := range images {
+		images[i] = newJPEG(is, 10, 10, color.White)
+	}
+
+	_, err := Concat(images, 2, 3)
+	is.True(errors.Is(err, ErrGridTooSmall))
+	is.True(strings.Contains(err.Error(), "2 rows and 3 cols can't hold 10 images"))
+
+	_, err = Concat(images, 0, 3)
+	is.True(errors.Is(err, ErrGridTooSmall))
+}
+
+func TestDimensions(t *testing.T) {
+	is := is.New(t)
+
+	for _, b := range [][]byte{newJPEG(is, 640, 480, color.White), newPNG(is, 640, 480, color.White)} {
+		w, h, err := Dimensions(b)
+		is.NoErr(err)
+		is.Equal(640, w)
+		is.Equal(480, h)
+
+		// the pixels aren't needed
+		w, h, err = Dimensions(b[:len(b)/2])
+		is.NoErr(err)
+		is.Equal(640, w)
+		is.Equal(480, h)
+	}
+
+	// rotated by the EXIF orientation
+	w, h, err := Dimensions(withOrientation(newJPEG(is, 640, 480, color.White), 6))
+	is.NoErr(err)
+	is.Equal(480, w)
+	is.Equal(640, h)
+
+	_, _, err = Dimensions([]byte("garbage"))
+	is.True(err != nil)
+}
+
+func TestConcatTo(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{
+		newJPEG(is, 100, 100, color.RGBA{R: 255, A: 255}),
+		newJPEG(is, 100, 100, color.RGBA{B: 255, A: 255}),
+	}
+
+	w := &bytes.Buffer{}
+	err := ConcatTo(images, 1, 2, w)
+	is.NoErr(err)
+
+	img, format, err := image.Decode(w)
+	is.NoErr(err)
+	is.Equal("jpeg", format)
+	is.Equal(image.Pt(200, 100), img.Bounds().Size())
+
+	w.Reset()
+	err = ConcatTo([][]byte{[]byte("garbage")}, 1, 1, w)
+	is.True(err != nil)
+	is.Equal(0, w.Len())
+}
+
+func TestConcatPaged(t *testing.T) {
+	is := is.New(t)
+
+	var images [][]byte
+	for range 23 {
+		images = append(images, newPNG(is, 10, 10, color.RGBA{R: 255, A: 255}))
+	}
+
+	pages, err := ConcatPaged(images, 9, WithFormat(FormatPNG))
+	is.NoErr(err)
+	is.Equal(3, len(pages))
+
+	for i, cells := range []int{9, 9, 5} {
+		img, err := png.Decode(bytes.NewReader(pages[i]))
+		is.NoErr(err)
+		is.Equal(30, img.Bounds().Dx())
+
+		var count int
+		for y := 5; y < img.Bounds().Dy(); y += 10 {
+			for x := 5; x < img.Bounds().Dx(); x += 10 {
+				if isRed(img.At(x, y)) {
+					count++
+				}
+			}
+		}
+		is.Equal(cells, count)
+	}
+
+	images[10] = []byte("garbage")
+	pages, err = ConcatPaged(images, 9, WithSkipInvalid(true))
+	var skipped *SkippedError
+	is.True(errors.As(err, &skipped))
+	is.Equal([]int{10}, skipped.Indexes)
+	is.Equal(3, len(pages))
+
+	_, err = ConcatPaged(images, 0)
+	is.True(err != nil)
+}
+
+func TestConcatWebP(t *testing.T) {
+	is := is.New(t)
+
+	webp, err := os.ReadFile("testdata/photo.webp")
+	is.NoErr(err)
+
+	img, err := decode(webp)
+	is.NoErr(err)
+	is.True(!img.Bounds().Empty())
+
+	collage, err := Concat([][]byte{webp, newJPEG(is, 10, 10, color.White)}, 1, 2)
+	is.NoErr(err)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal(2*img.Bounds().Dx(), cfg.Width)
+	is.Equal(img.Bounds().Dy(), cfg.Height)
+}
+
+func TestConcatAnimatedGIF(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	palette := color.Palette{red, blue}
+
+	g := &gif.GIF{}
+	for i := range 3 {
+		frame := image.NewPaletted(image.Rect(0, 0, 20, 20), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(min(i, 1))
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	buf := &bytes.Buffer{}
+	is.NoErr(gif.EncodeAll(buf, g))
+
+	img, err := decode(buf.Bytes())
+	is.NoErr(err)
+	_, ok := img.(*image.RGBA)
+	is.True(ok)
+	is.Equal(red, img.At(10, 10))
+
+	collage, err := Concat([][]byte{buf.Bytes()}, 1, 1, WithFormat(FormatPNG))
+	is.NoErr(err)
+	cell, err := png.Decode(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal(image.Pt(20, 20), cell.Bounds().Size())
+	is.True(isRed(cell.At(10, 10)))
+}
+
+func TestConcatCornerRadius(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	black := color.RGBA{A: 255}
+	images := []image.Image{newImage(100, 100, red), newImage(100, 100, red)}
+
+	collage := concat(images, 1, 2, newOptions([]Option{WithCornerRadius(20), WithBackground(black)}))
+	for _, p := range []image.Point{{0, 0}, {99, 0}, {0, 99}, {99, 99}, {100, 0}, {199, 99}} {
+		is.Equal(black, collage.At(p.X, p.Y))
+	}
+	is.Equal(red, collage.At(50, 0))
+	is.Equal(red, collage.At(0, 50))
+	is.Equal(red, collage.At(50, 50))
+
+	// corners are transparent with the transparent background
+	collage = concat(images, 1, 2, newOptions([]Option{WithCornerRadius(20), WithFormat(FormatPNG), WithBackground(color.Transparent)}))
+	_, _, _, a := collage.At(0, 0).RGBA()
+	is.Equal(uint32(0), a)
+	_, _, _, a = collage.At(50, 50).RGBA()
+	is.Equal(uint32(0xffff), a)
+}
+
+func TestConcatCellBorder(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	images := []image.Image{newImage(100, 100, red), newImage(100, 100, red)}
+
+	collage := concat(images, 1, 2, newOptions([]Option{WithCellBorder(5, blue), WithPadding(10, false)}))
+	is.Equal(image.Pt(2*110+10, 110), collage.Bounds().Size())
+
+	is.Equal(blue, collage.At(0, 0))
+	is.Equal(blue, collage.At(4, 50))
+	is.Equal(red, collage.At(5, 5))
+	is.Equal(red, collage.At(104, 104))
+	is.Equal(blue, collage.At(105, 50))
+	is.Equal(blue, collage.At(109, 109))
+	is.Equal(white, collage.At(115, 50)) // padding between cells
+	is.Equal(blue, collage.At(120, 50))
+	is.Equal(red, collage.At(125, 50))
+}
+
+func TestConcatFitCrop(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	green := color.RGBA{G: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+
+	// 3:1 panorama with red, green and blue thirds
+	panorama := newImage(300, 100, red)
+	draw.Draw(panorama, image.Rect(100, 0, 200, 100), &image.Uniform{green}, image.Point{}, draw.Src)
+	draw.Draw(panorama, image.Rect(200, 0, 300, 100), &image.Uniform{blue}, image.Point{}, draw.Src)
+
+	images := []image.Image{newImage(100, 100, red), panorama}
+	collage := concat(images, 1, 2, newOptions([]Option{WithFit(FitCrop)}))
+	is.Equal(image.Pt(200, 100), collage.Bounds().Size())
+
+	// only the central part is kept
+	for _, p := range []image.Point{{100, 0}, {150, 50}, {199, 99}} {
+		is.Equal(green, collage.At(p.X, p.Y))
+	}
+
+	// tall images are cropped from the middle too
+	images[1] = image.NewRGBA(image.Rect(0, 0, 100, 300))
+	draw.Draw(images[1].(*image.RGBA), image.Rect(0, 100, 100, 200), &image.Uniform{green}, image.Point{}, draw.Src)
+	collage = concat(images, 1, 2, newOptions([]Option{WithFit(FitCrop)}))
+	is.Equal(green, collage.At(100, 0))
+	is.Equal(green, collage.At(199, 99))
+}
+
+func TestConcatWithResult(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{
+		newPNG(is, 100, 80, color.White),
+		newPNG(is, 50, 50, color.White),
+		newPNG(is, 10, 10, color.White),
+	}
+
+	collage, res, err := ConcatWithResult(images, 2, 2, WithPadding(4, false))
+	is.NoErr(err)
+	is.Equal(ConcatResult{
+		Width:      204,
+		Height:     164,
+		CellWidth:  100,
+		CellHeight: 80,
+		Rows:       2,
+		Cols:       2,
+		Images:     3,
+	}, res)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(collage))
+	is.NoErr(err)
+	is.Equal(res.Width, cfg.Width)
+	is.Equal(res.Height, cfg.Height)
+}
+
+func newImage(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	return img
+}
+
+func newPNG(is *is.I, w, h int, c color.Color) []byte {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, newImage(w, h, c))
+	is.NoErr(err)
+	return buf.Bytes()
+}
+
+func newJPEG(is *is.I, w, h int, c color.Color) []byte {
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, newImage(w, h, c), &jpeg.Options{Quality: 100})
+	is.NoErr(err)
+	return buf.Bytes()
+}
+
+func TestConcatProgressive(t *testing.T) {
+	is := is.New(t)
+
+	images := [][]byte{newJPEG(is, 10, 10, color.White), newJPEG(is, 10, 10, color.Black)}
+
+	var calls, quality int
+	encoder := func(w io.Writer, img image.Image, q int) error {
+		calls++
+		quality = q
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: q})
+	}
+
+	_, err := Concat(images, 1, 2, WithProgressiveEncoder(encoder))
+	is.NoErr(err)
+	is.Equal(0, calls) // baseline unless asked
+
+	b, err := Concat(images, 1, 2, WithProgressive(true), WithProgressiveEncoder(encoder), WithQuality(70))
+	is.NoErr(err)
+	is.Equal(1, calls)
+	is.Equal(70, quality)
+	_, err = jpeg.Decode(bytes.NewReader(b))
+	is.NoErr(err)
+
+	// png has no progressive mode
+	_, err = Concat(images, 1, 2, WithProgressive(true), WithProgressiveEncoder(encoder), WithFormat(FormatPNG))
+	is.NoErr(err)
+	is.Equal(1, calls)
+
+	// the standard library can't encode progressive JPEGs
+	_, err = Concat(images, 1, 2, WithProgressive(true))
+	is.True(errors.Is(err, ErrNoProgressiveEncoder))
+}
@@ -0,0 +1,91 @@
+package image
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// DefaultTitleHeight is the height of the title band when none is set.
+const DefaultTitleHeight = 30
+
+var titleFace font.Face = basicfont.Face7x13
+
+// addTitle puts the grid under a band of the title height with the title centered in it.
+func addTitle(grid draw.Image, o options) draw.Image {
+	if o.title == "" {
+		return grid
+	}
+
+	face, height := titleFace, DefaultTitleHeight
+	if o.font != nil {
+		f, err := opentype.NewFace(o.font, &opentype.FaceOptions{Size: o.fontSize, DPI: 72, Hinting: font.HintingFull})
+		// the font is parsed already, so it fails only on broken glyph tables
+		if err == nil {
+			defer f.Close()
+			metrics := f.Metrics()
+			// half of the text height above and below it like the default band has
+			face, height = f, 2*(metrics.Ascent+metrics.Descent).Ceil()
+		}
+	}
+	if o.titleHeight > 0 {
+		height = o.titleHeight
+	}
+
+	b := grid.Bounds()
+	dst := newCanvas(image.Rect(0, 0, b.Dx(), b.Dy()+height), o.format)
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{o.background}, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(0, height, b.Dx(), b.Dy()+height), grid, b.Min, draw.Src)
+
+	drawText(dst, image.Rect(0, 0, b.Dx(), height), o.title, face, textColor(o.background))
+	return dst
+}
+
+// drawText draws a single line of text centered inside r.
+func drawText(dst draw.Image, r image.Rectangle, text string, face font.Face, c color.Color) {
+	d := &font.Drawer{Dst: dst, Src: &image.Uniform{c}, Face: face}
+
+	metrics := face.Metrics()
+	width := d.MeasureString(text)
+	height := metrics.Ascent + metrics.Descent
+
+	x := fixed.I(r.Min.X) + (fixed.I(r.Dx())-width)/2
+	y := fixed.I(r.Min.Y) + (fixed.I(r.Dy())-height)/2 + metrics.Ascent
+	d.Dot = fixed.Point26_6{X: x, Y: y}
+	d.DrawString(text)
+}
+
+// drawLabel draws the label on a dark box in the top left corner of the cell.
+func drawLabel(dst draw.Image, cell image.Rectangle, label string) {
+	const padding = 2
+
+	d := &font.Drawer{Face: titleFace}
+	metrics := titleFace.Metrics()
+	width := d.MeasureString(label).Ceil() + 2*padding
+	height := (metrics.Ascent + metrics.Descent).Ceil() + 2*padding
+
+	box := image.Rect(cell.Min.X, cell.Min.Y, cell.Min.X+width, cell.Min.Y+height).Intersect(cell)
+	draw.Draw(dst, box, &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	drawText(dst, box, label, titleFace, color.White)
+}
+
+// textColor returns black or white, whichever is more readable on the background.
+func textColor(background color.Color) color.Color {
+	r, g, b, a := background.RGBA()
+	// transparent background is most likely shown over a light one
+	if a < 0x8000 {
+		return color.Black
+	}
+
+	luminance := (299*r + 587*g + 114*b) / 1000
+	if luminance > 0x8000 {
+		return color.Black
+	}
+
+	return color.White
+}
@@ -0,0 +1,84 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+)
+
+func TestConcatTitle(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	images := []image.Image{newImage(100, 100, red), newImage(100, 100, red)}
+
+	collage := concat(images, 1, 2, newOptions([]Option{WithTitle("2024-08-31")}))
+	is.Equal(image.Pt(200, 100+DefaultTitleHeight), collage.Bounds().Size())
+	is.Equal(white, collage.At(0, 0))
+	is.Equal(red, collage.At(0, DefaultTitleHeight))
+
+	// some of the band pixels are the text
+	var text int
+	for y := range DefaultTitleHeight {
+		for x := range 200 {
+			if collage.At(x, y) != white {
+				text++
+			}
+		}
+	}
+	is.True(text > 0)
+
+	collage = concat(images, 1, 2, newOptions([]Option{WithTitle("2024-08-31"), WithTitleHeight(50)}))
+	is.Equal(image.Pt(200, 150), collage.Bounds().Size())
+}
+
+func TestConcatTitleFont(t *testing.T) {
+	is := is.New(t)
+
+	f, err := opentype.Parse(goregular.TTF)
+	is.NoErr(err)
+
+	images := []image.Image{newImage(100, 100, color.White), newImage(100, 100, color.White)}
+
+	small := concat(images, 1, 2, newOptions([]Option{WithTitle("2024-08-31"), WithFont(f, 12)}))
+	large := concat(images, 1, 2, newOptions([]Option{WithTitle("2024-08-31"), WithFont(f, 24)}))
+	smallBand := small.Bounds().Dy() - 100
+	largeBand := large.Bounds().Dy() - 100
+	is.True(smallBand > 0)
+	is.True(largeBand >= 2*smallBand-2) // rounding of the font metrics
+
+	// an explicit height wins over the font one
+	collage := concat(images, 1, 2, newOptions([]Option{WithTitle("2024-08-31"), WithFont(f, 24), WithTitleHeight(20)}))
+	is.Equal(image.Pt(200, 120), collage.Bounds().Size())
+}
+
+func TestTextColor(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(color.Black, textColor(color.White))
+	is.Equal(color.White, textColor(color.Black))
+	is.Equal(color.Black, textColor(color.Transparent))
+}
+
+func TestConcatLabelCells(t *testing.T) {
+	is := is.New(t)
+
+	red := color.RGBA{R: 255, A: 255}
+	images := []image.Image{newImage(50, 50, red), newImage(50, 50, red), newImage(50, 50, red)}
+
+	plain := concat(images, 2, 2, newOptions(nil))
+	labeled := concat(images, 2, 2, newOptions([]Option{WithLabelCells(true)}))
+	is.Equal(plain.Bounds(), labeled.Bounds())
+
+	// every image cell has a label in the corner, the rest stays untouched
+	for _, corner := range []image.Point{{0, 0}, {50, 0}, {0, 50}} {
+		is.True(plain.At(corner.X, corner.Y) != labeled.At(corner.X, corner.Y))
+	}
+	is.Equal(plain.At(25, 40), labeled.At(25, 40))
+	is.Equal(plain.At(50, 50), labeled.At(50, 50))
+}
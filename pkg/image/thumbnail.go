@@ -0,0 +1,34 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/image/draw"
+)
+
+// Thumbnail downscales a single image to fit within maxDim keeping its
+// aspect ratio and encodes it as JPEG. Smaller images are not upscaled.
+func Thumbnail(img []byte, maxDim int) ([]byte, error) {
+	if maxDim <= 0 {
+		return nil, fmt.Errorf("invalid thumbnail size %d", maxDim)
+	}
+
+	src, err := decode(img)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail: %w", err)
+	}
+
+	o := newOptions([]Option{WithMaxDimension(maxDim)})
+
+	canvas := newCanvas(src.Bounds(), o.format)
+	draw.Draw(canvas, canvas.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	w := &bytes.Buffer{}
+	err = encode(w, downscale(canvas, o), o)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail: %w", err)
+	}
+
+	return w.Bytes(), nil
+}
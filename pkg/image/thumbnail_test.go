@@ -0,0 +1,45 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestThumbnail(t *testing.T) {
+	is := is.New(t)
+
+	tests := []struct {
+		w, h   int
+		maxDim int
+	}{
+		{1000, 500, 128},
+		{300, 1000, 100},
+		{640, 480, 64},
+		{50, 20, 100}, // not upscaled
+	}
+	for _, tt := range tests {
+		thumb, err := Thumbnail(newJPEG(is, tt.w, tt.h, color.White), tt.maxDim)
+		is.NoErr(err)
+
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+		is.NoErr(err)
+		is.Equal("jpeg", format)
+		is.True(cfg.Width <= tt.maxDim)
+		is.True(cfg.Height <= tt.maxDim)
+
+		// aspect ratio is kept within a pixel
+		expectedHeight := float64(cfg.Width) * float64(tt.h) / float64(tt.w)
+		is.True(expectedHeight-float64(cfg.Height) < 1)
+		is.True(float64(cfg.Height)-expectedHeight < 1)
+	}
+
+	_, err := Thumbnail([]byte("garbage"), 100)
+	is.True(err != nil)
+
+	_, err = Thumbnail(newJPEG(is, 10, 10, color.White), 0)
+	is.True(err != nil)
+}